@@ -0,0 +1,62 @@
+package powerstrip
+
+import (
+	"context"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// CallContext is client.CallContext: like client.Call, but gives up once
+// ctx is done. The deadline of ctx is sent along with the call, and the
+// server is told when the host gives up, so that a method taking a
+// context.Context first sees it cancelled.
+//
+// If ctx is done first, CallContext returns ctx.Err() and reply must not
+// be used, since the response may still be decoded into it.
+func CallContext(
+	ctx context.Context, client Caller, serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	return client.CallContext(ctx, serviceMethod, args, reply, opts...)
+}
+
+// callContext makes a call on c. The server is only told about cancels if
+// the call goes through a RPCClient.
+func (c *rpcCaller) callContext(
+	ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var meta callMeta
+	if c.rpc != nil && ctx.Done() != nil {
+		meta.id = atomic.AddUint64(&c.rpc.nextCallID, 1)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		meta.deadline = deadline
+	}
+
+	var call *rpc.Call
+	send := func() {
+		call = c.client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	}
+	if c.codec != nil {
+		c.codec.send(meta, send)
+	} else {
+		send()
+	}
+
+	select {
+	case <-call.Done:
+		return DecodeError(call.Error)
+	case <-ctx.Done():
+		if meta.id != 0 {
+			go c.rpc.cancel(meta.id)
+		}
+		return ctx.Err()
+	}
+}
+
+// cancel tells the server to cancel the call id.
+func (c *RPCClient) cancel(id uint64) error {
+	var empty struct{}
+	return c.call("Control.Cancel", id, &empty)
+}
@@ -0,0 +1,156 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+)
+
+// CallLimits limits the calls in flight on each dispensed implementation
+// of a plugin. An implementation that is shared between dispenses, with
+// DispenseSingleton or DispensePool, is limited across all of them.
+type CallLimits struct {
+	// MaxCalls, if positive, is the most calls an implementation serves
+	// at once.
+	MaxCalls int
+
+	// MethodMaxCalls limits the calls of single methods, by method name,
+	// on top of MaxCalls.
+	MethodMaxCalls map[string]int
+
+	// Serial serves the calls of an implementation one at a time, for
+	// implementations that aren't safe for concurrent use. It is a
+	// MaxCalls of 1.
+	Serial bool
+
+	// Reject fails the calls over a limit right away with ErrTooManyCalls.
+	// By default they wait in line, until their context is done.
+	Reject bool
+}
+
+// ErrTooManyCalls is returned for a call over the CallLimits of a plugin
+// that rejects them. The host can retry it with a RetryPolicy whose
+// Retryable matches it.
+var ErrTooManyCalls = errors.New("too many calls in flight")
+
+func init() {
+	RegisterError("powerstrip.too-many-calls", ErrTooManyCalls)
+}
+
+// CallLimitsPlugin is implemented by plugins whose calls are limited.
+// WithCallLimits adds limits to an existing plugin.
+type CallLimitsPlugin interface {
+	Plugin
+
+	CallLimits() CallLimits
+}
+
+// WithCallLimits returns p with the given call limits, to be used as an
+// entry of a PluginSet.
+func WithCallLimits(p Plugin, limits CallLimits) Plugin {
+	return &limitsPlugin{Plugin: p, limits: limits}
+}
+
+// limitsPlugin adds call limits to a plugin.
+type limitsPlugin struct {
+	Plugin
+	limits CallLimits
+}
+
+func (p *limitsPlugin) CallLimits() CallLimits {
+	return p.limits
+}
+
+func (p *limitsPlugin) unwrap() Plugin {
+	return p.Plugin
+}
+
+// callLimiter enforces the CallLimits of an implementation. Its
+// semaphores are channels that hold a value per call in flight.
+type callLimiter struct {
+	all     chan struct{}
+	methods map[string]chan struct{}
+	reject  bool
+}
+
+// newCallLimiter returns the limiter of limits, or nil if there are none.
+func newCallLimiter(limits CallLimits) *callLimiter {
+	l := &callLimiter{reject: limits.Reject}
+	max := limits.MaxCalls
+	if limits.Serial {
+		max = 1
+	}
+	if max > 0 {
+		l.all = make(chan struct{}, max)
+	}
+	for name, n := range limits.MethodMaxCalls {
+		if n <= 0 {
+			continue
+		}
+		if l.methods == nil {
+			l.methods = make(map[string]chan struct{})
+		}
+		l.methods[name] = make(chan struct{}, n)
+	}
+
+	if l.all == nil && l.methods == nil {
+		return nil
+	}
+	return l
+}
+
+// acquire takes the slots of a call to method, and returns the function
+// that gives them back.
+func (l *callLimiter) acquire(ctx context.Context, method string) (func(), error) {
+	// The method's slot comes first, so that a call waiting for it doesn't
+	// hold one of the implementation's.
+	var sems []chan struct{}
+	if sem := l.methods[method]; sem != nil {
+		sems = append(sems, sem)
+	}
+	if l.all != nil {
+		sems = append(sems, l.all)
+	}
+
+	release := func() {
+		for _, sem := range sems {
+			<-sem
+		}
+	}
+	for i, sem := range sems {
+		if err := l.take(ctx, sem); err != nil {
+			for _, taken := range sems[:i] {
+				<-taken
+			}
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+func (l *callLimiter) take(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.reject {
+		return ErrTooManyCalls
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pluginLimiter returns a new limiter for an implementation of p, or nil
+// if its calls aren't limited.
+func pluginLimiter(p Plugin) *callLimiter {
+	lp, ok := lookupPlugin[CallLimitsPlugin](p)
+	if !ok {
+		return nil
+	}
+	return newCallLimiter(lp.CallLimits())
+}
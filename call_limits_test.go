@@ -0,0 +1,282 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLimitServer tracks the calls in flight.
+type testLimitServer struct {
+	startedCh chan struct{}
+	unblockCh chan struct{}
+
+	active, max int32
+}
+
+func newTestLimitServer() *testLimitServer {
+	return &testLimitServer{
+		startedCh: make(chan struct{}, 10),
+		unblockCh: make(chan struct{}),
+	}
+}
+
+// Block waits until the test unblocks it.
+func (s *testLimitServer) Block(null bool, _ *struct{}) error {
+	s.startedCh <- struct{}{}
+	<-s.unblockCh
+	return nil
+}
+
+// Work takes d, and records how many calls were in flight at most.
+func (s *testLimitServer) Work(d time.Duration, _ *struct{}) error {
+	n := atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func (s *testLimitServer) Fast(null bool, _ *struct{}) error {
+	return nil
+}
+
+// waitStarted waits for n Block calls to be in flight.
+func (s *testLimitServer) waitStarted(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.startedCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("call didn't start")
+		}
+	}
+}
+
+// testLimitPlugin serves the same testLimitServer to every dispense. Its
+// client is the bare Caller.
+type testLimitPlugin struct {
+	server *testLimitServer
+}
+
+func (p *testLimitPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return p.server, nil
+}
+
+func (p *testLimitPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+func testLimitDispense(t *testing.T, limits CallLimits) (Caller, *testLimitServer) {
+	server := newTestLimitServer()
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"limit": WithCallLimits(&testLimitPlugin{server: server}, limits),
+	})
+	t.Cleanup(func() { client.Close() })
+
+	raw, err := client.Dispense("limit")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return raw.(Caller), server
+}
+
+// goCall makes a call in the background, and returns where its error goes.
+func goCall(c Caller, method string, args interface{}) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Call(method, args, new(struct{}))
+	}()
+	return errCh
+}
+
+func TestCallLimits_serial(t *testing.T) {
+	c, server := testLimitDispense(t, CallLimits{Serial: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Call("Plugin.Work", 10*time.Millisecond, new(struct{})); err != nil {
+				t.Errorf("err: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&server.max); max != 1 {
+		t.Fatalf("bad: %d", max)
+	}
+}
+
+func TestCallLimits_reject(t *testing.T) {
+	c, server := testLimitDispense(t, CallLimits{MaxCalls: 2, Reject: true})
+
+	errChs := []<-chan error{
+		goCall(c, "Plugin.Block", true),
+		goCall(c, "Plugin.Block", true),
+	}
+	server.waitStarted(t, 2)
+
+	err := c.Call("Plugin.Fast", true, new(struct{}))
+	if !errors.Is(err, ErrTooManyCalls) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	close(server.unblockCh)
+	for _, errCh := range errChs {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := c.Call("Plugin.Fast", true, new(struct{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCallLimits_method(t *testing.T) {
+	c, server := testLimitDispense(t, CallLimits{
+		MethodMaxCalls: map[string]int{"Block": 1},
+		Reject:         true,
+	})
+
+	errCh := goCall(c, "Plugin.Block", true)
+	server.waitStarted(t, 1)
+
+	err := c.Call("Plugin.Block", true, new(struct{}))
+	if !errors.Is(err, ErrTooManyCalls) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The other methods aren't limited.
+	if err := c.Call("Plugin.Fast", true, new(struct{})); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	close(server.unblockCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCallLimits_queue(t *testing.T) {
+	c, server := testLimitDispense(t, CallLimits{MaxCalls: 1})
+
+	errCh := goCall(c, "Plugin.Block", true)
+	server.waitStarted(t, 1)
+
+	// A call waiting in line gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.CallContext(ctx, "Plugin.Fast", true, new(struct{}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Another one goes through once the first call is done.
+	queued := goCall(c, "Plugin.Fast", true)
+	select {
+	case err := <-queued:
+		t.Fatalf("should wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(server.unblockCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := <-queued; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCallLimits_shared(t *testing.T) {
+	server := newTestLimitServer()
+	p := WithCallLimits(&testLimitPlugin{server: server}, CallLimits{Serial: true, Reject: true})
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"limit": WithDispensePolicy(p, DispensePolicy{Mode: DispenseSingleton}),
+	})
+	defer client.Close()
+
+	var callers []Caller
+	for i := 0; i < 2; i++ {
+		raw, err := client.Dispense("limit")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		callers = append(callers, raw.(Caller))
+	}
+
+	// The singleton is limited across its dispenses.
+	errCh := goCall(callers[0], "Plugin.Block", true)
+	server.waitStarted(t, 1)
+
+	err := callers[1].Call("Plugin.Fast", true, new(struct{}))
+	if !errors.Is(err, ErrTooManyCalls) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	close(server.unblockCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// testUnhashableLimitPlugin serves its testLimitServer in a value that
+// can't be used as a map key.
+type testUnhashableLimitPlugin struct {
+	server *testLimitServer
+}
+
+type testUnhashableLimitServer struct {
+	*testLimitServer
+	tags []string
+}
+
+func (p *testUnhashableLimitPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return testUnhashableLimitServer{testLimitServer: p.server}, nil
+}
+
+func (p *testUnhashableLimitPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+func TestCallLimits_sharedUnhashable(t *testing.T) {
+	server := newTestLimitServer()
+	p := WithCallLimits(&testUnhashableLimitPlugin{server: server}, CallLimits{Serial: true, Reject: true})
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"limit": WithDispensePolicy(p, DispensePolicy{Mode: DispenseSingleton}),
+	})
+	defer client.Close()
+
+	var callers []Caller
+	for i := 0; i < 2; i++ {
+		raw, err := client.Dispense("limit")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		callers = append(callers, raw.(Caller))
+	}
+
+	// The singleton still shares its limiter between its dispenses.
+	errCh := goCall(callers[0], "Plugin.Block", true)
+	server.waitStarted(t, 1)
+
+	err := callers[1].Call("Plugin.Fast", true, new(struct{}))
+	if !errors.Is(err, ErrTooManyCalls) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	close(server.unblockCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
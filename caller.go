@@ -0,0 +1,235 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"time"
+)
+
+// Caller makes calls to the other side of a connection: to the server of
+// a dispensed plugin, which Plugin.Client is handed one for, or to a
+// service dialed with MuxBroker.DialRPC or HostService. Errors are
+// decoded with DecodeError.
+//
+// On the host, the calls of the Callers handed to Plugin.Client go
+// through the ClientConfig.Interceptors, with the ClientConfig.CallOptions
+// and then the options given to the call.
+type Caller interface {
+	// Call calls serviceMethod, e.g. "Plugin.Double", and waits for its
+	// reply.
+	Call(serviceMethod string, args, reply interface{}, opts ...CallOption) error
+
+	// CallContext is like Call, but gives up once ctx is done. The
+	// deadline of ctx is sent along with the call, and the server is told
+	// when the host gives up, so that a method taking a context.Context
+	// first sees it cancelled. If ctx is done first, it returns ctx.Err()
+	// and reply must not be used, since the response may still be decoded
+	// into it.
+	CallContext(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...CallOption) error
+
+	// Close closes the connection. Calls in progress fail.
+	Close() error
+}
+
+// CallOptions are the options of a call.
+type CallOptions struct {
+	// Timeout, if positive, bounds each attempt at the call. An attempt
+	// that runs out of it fails with context.DeadlineExceeded.
+	Timeout time.Duration
+
+	// Idempotent marks a call that is safe to make more than once. Only
+	// those are retried.
+	Idempotent bool
+
+	// Retry is how an idempotent call is retried when it fails.
+	Retry RetryPolicy
+}
+
+// RetryPolicy is how idempotent calls are retried.
+type RetryPolicy struct {
+	// Attempts is the most times a call is made, counting the first one.
+	// Calls aren't retried unless it is more than 1.
+	Attempts int
+
+	// Backoff is the wait before the first retry. It doubles for every
+	// retry after that.
+	Backoff time.Duration
+
+	// Retryable reports whether an attempt that failed with err is
+	// retried. By default, only attempts that ran out of their Timeout
+	// are. Nothing is retried once the context of the call is done.
+	Retryable func(err error) bool
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// CallOption sets an option of a call.
+type CallOption func(*CallOptions)
+
+// WithTimeout bounds each attempt at the call to d.
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *CallOptions) { o.Timeout = d }
+}
+
+// Idempotent marks the call as safe to retry.
+func Idempotent() CallOption {
+	return func(o *CallOptions) { o.Idempotent = true }
+}
+
+// WithRetry retries the call with p, if it is idempotent.
+func WithRetry(p RetryPolicy) CallOption {
+	return func(o *CallOptions) { o.Retry = p }
+}
+
+// ClientCall describes a call the host makes, for client interceptors.
+type ClientCall struct {
+	// Plugin is the name of the dispensed plugin the call goes to, or
+	// empty for the calls the host makes to manage the plugin, like
+	// Control.Ping and Dispenser.Dispense.
+	Plugin string
+
+	// ServiceMethod is the method called, e.g. "Plugin.Double".
+	ServiceMethod string
+
+	// Args is the argument of the call, and Reply the pointer its result
+	// is decoded into.
+	Args  interface{}
+	Reply interface{}
+
+	// Options are the options the call is made with. An interceptor may
+	// change them before it calls invoke.
+	Options CallOptions
+}
+
+// ClientInterceptor runs around the calls the host makes, to add metrics,
+// default options or checks. It calls invoke to make the call, with ctx or
+// a context derived from it, and returns the error the caller gets, which
+// is usually what invoke returned.
+type ClientInterceptor func(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error
+
+// rpcCaller is the Caller of a connection.
+type rpcCaller struct {
+	client *rpc.Client
+
+	// codec sends the metadata of calls, if set.
+	codec metaClientCodec
+
+	// rpc is the connection to the plugin the calls go through, for its
+	// interceptors and options and to cancel calls. It is nil for the
+	// connections a plugin dials.
+	rpc *RPCClient
+
+	// plugin is the name of the dispensed plugin, if any.
+	plugin string
+}
+
+func (c *rpcCaller) Call(serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	return c.CallContext(context.Background(), serviceMethod, args, reply, opts...)
+}
+
+func (c *rpcCaller) CallContext(
+	ctx context.Context, serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	call := &ClientCall{
+		Plugin:        c.plugin,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+	}
+
+	var interceptors []ClientInterceptor
+	if c.rpc != nil {
+		interceptors = c.rpc.interceptors
+
+		// The calls ClientProtocol makes itself, like Dispense, aren't all
+		// safe to retry, so they only get the options they are made with.
+		if c.plugin != "" {
+			for _, opt := range c.rpc.callOptions {
+				opt(&call.Options)
+			}
+		}
+	}
+	for _, opt := range opts {
+		opt(&call.Options)
+	}
+
+	invoke := func(ctx context.Context) error {
+		return c.invoke(ctx, call)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func(ctx context.Context) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoke(ctx)
+}
+
+func (c *rpcCaller) Close() error {
+	return c.client.Close()
+}
+
+// invoke makes call with its options, retrying it if it is idempotent.
+func (c *rpcCaller) invoke(ctx context.Context, call *ClientCall) error {
+	opts := call.Options
+	if !opts.Idempotent || opts.Retry.Attempts <= 1 {
+		return c.attempt(ctx, call.ServiceMethod, call.Args, call.Reply, opts.Timeout)
+	}
+
+	// Every attempt decodes into a reply of its own, since one that gave
+	// up may still be decoded into. A nil reply discards the results.
+	var replyType reflect.Type
+	if call.Reply != nil {
+		rv := reflect.ValueOf(call.Reply)
+		if rv.Kind() != reflect.Ptr || rv.IsNil() {
+			return fmt.Errorf("%s: reply %T isn't a pointer", call.ServiceMethod, call.Reply)
+		}
+		replyType = rv.Type().Elem()
+	}
+	backoff := opts.Retry.Backoff
+	var err error
+	for i := 0; i < opts.Retry.Attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		var reply interface{}
+		if replyType != nil {
+			reply = reflect.New(replyType).Interface()
+		}
+		err = c.attempt(ctx, call.ServiceMethod, call.Args, reply, opts.Timeout)
+		if err == nil {
+			if reply != nil {
+				reflect.ValueOf(call.Reply).Elem().Set(reflect.ValueOf(reply).Elem())
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !opts.Retry.retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt makes a call once, giving up after timeout if it is positive.
+func (c *rpcCaller) attempt(
+	ctx context.Context, serviceMethod string, args, reply interface{}, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return c.callContext(ctx, serviceMethod, args, reply)
+}
@@ -0,0 +1,285 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSlowServer is slow for its first calls.
+type testSlowServer struct {
+	calls int32
+	slow  int32
+}
+
+// Call sleeps for d on the first slow calls, and replies with the number
+// of the call.
+func (s *testSlowServer) Call(d time.Duration, reply *int) error {
+	n := atomic.AddInt32(&s.calls, 1)
+	if n <= s.slow {
+		time.Sleep(d)
+	}
+	*reply = int(n)
+	return nil
+}
+
+// testSlowPlugin serves a testSlowServer. Its client is the bare Caller.
+type testSlowPlugin struct {
+	Slow int32
+}
+
+func (p *testSlowPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return &testSlowServer{slow: p.Slow}, nil
+}
+
+func (p *testSlowPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+// testClientInterceptor records the calls it sees, as plugin:method.
+type testClientInterceptor struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (i *testClientInterceptor) intercept(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error {
+	i.lock.Lock()
+	i.calls = append(i.calls, call.Plugin+":"+call.ServiceMethod)
+	i.lock.Unlock()
+	return invoke(ctx)
+}
+
+func TestRPCClient_interceptors(t *testing.T) {
+	client, _ := testRPCConn(t, testPluginMap)
+	defer client.Close()
+
+	recorder := new(testClientInterceptor)
+	var args, reply interface{}
+	inspect := func(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error {
+		err := invoke(ctx)
+		if call.Plugin == "test" {
+			args, reply = call.Args, reflect.ValueOf(call.Reply).Elem().Interface()
+		}
+		return err
+	}
+	client.interceptors = []ClientInterceptor{recorder.intercept, inspect}
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := raw.(testInterface).Double(21); v != 42 {
+		t.Fatalf("bad: %d", v)
+	}
+
+	expected := []string{":Control.Ping", ":Dispenser.Dispense", "test:Plugin.Double"}
+	if !reflect.DeepEqual(recorder.calls, expected) {
+		t.Fatalf("bad: %#v", recorder.calls)
+	}
+	if args != 21 || reply != 42 {
+		t.Fatalf("bad: %v %v", args, reply)
+	}
+}
+
+func TestRPCClient_interceptorsReject(t *testing.T) {
+	client, _ := testRPCConn(t, testPluginMap)
+	defer client.Close()
+
+	errDenied := errors.New("denied")
+	client.interceptors = []ClientInterceptor{
+		func(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error {
+			if call.ServiceMethod == "Dispenser.Dispense" {
+				return errDenied
+			}
+			return invoke(ctx)
+		},
+	}
+
+	if _, err := client.Dispense("test"); err != errDenied {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCaller_timeout(t *testing.T) {
+	errCh := make(chan error, 1)
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"context": &testContextPlugin{ErrCh: errCh},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("context")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	err = c.Call("Plugin.Wait", 10*time.Second, new(struct{}), WithTimeout(50*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The server gave up too.
+	select {
+	case <-errCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("call wasn't cancelled on the server")
+	}
+}
+
+func TestCaller_retry(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"slow": &testSlowPlugin{Slow: 2},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("slow")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	retry := WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+	timeout := WithTimeout(100 * time.Millisecond)
+
+	// Calls that aren't idempotent aren't retried.
+	var reply int
+	err = c.Call("Plugin.Call", time.Second, &reply, timeout, retry)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	err = c.Call("Plugin.Call", time.Second, &reply, timeout, retry, Idempotent())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reply != 3 {
+		t.Fatalf("bad: %d", reply)
+	}
+
+	// The results of a retried call can be discarded, but not decoded
+	// into a value.
+	err = c.Call("Plugin.Call", time.Second, nil, timeout, retry, Idempotent())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = c.Call("Plugin.Call", time.Second, reply, timeout, retry, Idempotent())
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
+
+func TestCaller_retryable(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"slow": &testSlowPlugin{Slow: 1},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("slow")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	var retried []error
+	policy := RetryPolicy{
+		Attempts: 3,
+		Retryable: func(err error) bool {
+			retried = append(retried, err)
+			return false
+		},
+	}
+	var reply int
+	err = c.Call("Plugin.Call", time.Second, &reply,
+		WithTimeout(50*time.Millisecond), WithRetry(policy), Idempotent())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(retried) != 1 {
+		t.Fatalf("bad: %v", retried)
+	}
+}
+
+func TestRPCClient_callOptions(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"slow": &testSlowPlugin{Slow: 1},
+	})
+	defer client.Close()
+
+	// The options of the client apply first, and interceptors can change
+	// them.
+	client.callOptions = []CallOption{
+		WithTimeout(time.Hour),
+		WithRetry(RetryPolicy{Attempts: 2}),
+	}
+	var dispenseOpts CallOptions
+	client.interceptors = []ClientInterceptor{
+		func(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error {
+			if call.Plugin == "slow" {
+				call.Options.Idempotent = true
+			}
+			if call.ServiceMethod == "Dispenser.Dispense" {
+				dispenseOpts = call.Options
+			}
+			return invoke(ctx)
+		},
+	}
+
+	raw, err := client.Dispense("slow")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var reply int
+	err = raw.(Caller).Call("Plugin.Call", time.Second, &reply, WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reply != 2 {
+		t.Fatalf("bad: %d", reply)
+	}
+
+	// The calls the client makes itself, which aren't all safe to retry,
+	// don't get the options of the client.
+	if !reflect.DeepEqual(dispenseOpts, CallOptions{}) {
+		t.Fatalf("bad: %#v", dispenseOpts)
+	}
+}
+
+func TestClient_interceptors(t *testing.T) {
+	recorder := new(testClientInterceptor)
+	c := NewClient(&ClientConfig{
+		Cmd:          helperProcess("test-interface"),
+		Plugins:      testPluginMap,
+		Interceptors: []ClientInterceptor{recorder.intercept},
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := proto.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw.(testInterface).Double(1)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	expected := []string{":Control.Ping", ":Dispenser.Dispense", "test:Plugin.Double"}
+	if !reflect.DeepEqual(recorder.calls, expected) {
+		t.Fatalf("bad: %#v", recorder.calls)
+	}
+}
@@ -22,18 +22,37 @@ type Client struct {
 	exited    bool
 	l         sync.Mutex
 	addr      net.Addr
+	codec     string
 	proc      *os.Process
 	proto     ClientProtocol
 	doneCtx   context.Context
 	ctxCancel context.CancelFunc
 
+	// instanceDir holds the per-instance working and temp directories,
+	// and crashed tells whether the plugin exited with an error that we
+	// didn't cause, in which case instanceDir may be kept around.
+	instanceDir string
+	crashed     bool
+
+	// exitCh is closed once the process has exited and cmd.ProcessState
+	// is safe to read. Unlike exited it can be waited on while holding l.
+	exitCh chan struct{}
+
+	// hostServiceIDs maps the host services the plugin may use to their
+	// broker IDs.
+	hostServiceIDs map[string]uint32
+
+	// pairConn is the host end of the socketpair a sandboxed plugin is
+	// connected through. It is used instead of dialing addr.
+	pairConn net.Conn
+
 	clientWg sync.WaitGroup
 	stderrWg sync.WaitGroup
 
 	logger *log.Logger
 
-	// procKilled is used for testing only, to flag when the process was
-	// forcefully killed.
+	// procKilled flags when the process was forcefully killed, so that its
+	// exit isn't taken for a crash. Tests use it too.
 	procKilled bool
 }
 
@@ -44,6 +63,62 @@ type ClientConfig struct {
 	Stderr       io.Writer
 	SyncStdout   io.Writer
 	SyncStderr   io.Writer
+
+	// InstanceDir, if set, gives every plugin instance its own working
+	// directory and TMPDIR, which are removed by Kill. A Dir set on Cmd is
+	// kept as the working directory, and only TMPDIR is changed.
+	InstanceDir *InstanceDirConfig
+
+	// Sandbox, if set, starts the plugin in new user, mount, PID and
+	// network namespaces. This is only supported on Linux.
+	Sandbox *SandboxConfig
+
+	// HostServices maps names to implementations the host serves to the
+	// plugin, like loggers or config lookups. The plugin connects to them
+	// with MuxBroker.HostService, and calls their methods as
+	// "<name>.<Method>". They are served like dispensed implementations.
+	HostServices map[string]interface{}
+
+	// AllowedHostServices, if set, lists the HostServices this plugin may
+	// use, so that a host can hand the same HostServices to all its
+	// plugins. The others are neither advertised nor served to it.
+	AllowedHostServices []string
+
+	// Interceptors run around every call made to the plugin, the first one
+	// outermost: the calls of the Callers handed to Plugin.Client, and the
+	// ones ClientProtocol makes itself, like Ping and Dispense.
+	Interceptors []ClientInterceptor
+
+	// CallOptions are the options the calls of the Callers handed to
+	// Plugin.Client are made with, before the ones given to the call. The
+	// calls ClientProtocol makes itself don't get them. A RetryPolicy set
+	// here only applies to the calls marked Idempotent.
+	CallOptions []CallOption
+}
+
+// InstanceDirConfig configures the per-instance directories of a plugin.
+type InstanceDirConfig struct {
+	// Root is the directory the instance directories are created in. It
+	// defaults to os.TempDir().
+	Root string
+
+	// KeepOnCrash keeps the directories of a plugin that exited with an
+	// error on its own, for post-mortem debugging.
+	KeepOnCrash bool
+}
+
+// PluginStartError is returned by Start when the plugin reports that it
+// failed to start.
+type PluginStartError struct {
+	// Message is the reason the plugin gave.
+	Message string
+
+	// ExitCode is the plugin's exit code, or -1 if it didn't exit in time.
+	ExitCode int
+}
+
+func (e *PluginStartError) Error() string {
+	return fmt.Sprintf("plugin failed to start: %s (exit code %d)", e.Message, e.ExitCode)
 }
 
 func NewClient(config *ClientConfig) *Client {
@@ -99,6 +174,10 @@ func (c *Client) Start() (net.Addr, error) {
 	cmd.Env = append(cmd.Env, os.Environ()...)
 	cmd.Stdin = os.Stdin
 
+	if err := c.assignHostServices(); err != nil {
+		return nil, err
+	}
+
 	cmdStdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -108,9 +187,33 @@ func (c *Client) Start() (net.Addr, error) {
 		return nil, err
 	}
 
+	if c.config.InstanceDir != nil {
+		if err := c.createInstanceDir(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	var pairFile *os.File
+	if c.config.Sandbox != nil {
+		pairFile, err = c.sandbox(cmd)
+		if err != nil {
+			c.removeInstanceDir()
+			return nil, err
+		}
+	}
+
 	c.logger.Println("starting plugin", "path", cmd.Path, "args", cmd.Args)
 	err = cmd.Start()
+	if pairFile != nil {
+		// The plugin has its own copy of the descriptor now.
+		pairFile.Close()
+	}
 	if err != nil {
+		if c.pairConn != nil {
+			c.pairConn.Close()
+			c.pairConn = nil
+		}
+		c.removeInstanceDir()
 		return nil, err
 	}
 
@@ -121,6 +224,8 @@ func (c *Client) Start() (net.Addr, error) {
 	defer func() {
 		r := recover()
 		if err != nil || r != nil {
+			// A plugin that failed to start didn't crash.
+			c.procKilled = true
 			cmd.Process.Kill()
 		}
 		if r != nil {
@@ -130,6 +235,7 @@ func (c *Client) Start() (net.Addr, error) {
 
 	// Create a context for when we kill
 	c.doneCtx, c.ctxCancel = context.WithCancel(context.Background())
+	c.exitCh = make(chan struct{})
 
 	// Start goroutine that logs the stderr
 	c.clientWg.Add(1)
@@ -152,6 +258,7 @@ func (c *Client) Start() (net.Addr, error) {
 		c.stderrWg.Wait()
 
 		err := cmd.Wait()
+		close(c.exitCh)
 
 		debugMsgArgs := []interface{}{
 			"path", path,
@@ -168,6 +275,7 @@ func (c *Client) Start() (net.Addr, error) {
 		c.l.Lock()
 		defer c.l.Unlock()
 		c.exited = true
+		c.crashed = err != nil && !c.procKilled
 	}()
 
 	linesCh := make(chan string)
@@ -203,10 +311,34 @@ func (c *Client) Start() (net.Addr, error) {
 		}
 
 		switch parts[0] {
-		case "tcp":
-			addr, err = net.ResolveTCPAddr("tcp", parts[1])
-		case "unix":
-			addr, err = net.ResolveUnixAddr("unix", parts[1])
+		case "error":
+			// The plugin failed to set itself up. It exits right after
+			// telling us, so wait for its exit code.
+			startErr := &PluginStartError{Message: parts[1], ExitCode: -1}
+			select {
+			case <-c.exitCh:
+				startErr.ExitCode = cmd.ProcessState.ExitCode()
+			case <-timeout:
+			}
+			err = startErr
+		case "tcp", "unix":
+			// The codec is optional and defaults to gob, so plugins from
+			// before it was added still work.
+			rest := strings.SplitN(parts[1], "|", 2)
+			c.codec = CodecGob
+			if len(rest) == 2 {
+				c.codec = rest[1]
+			}
+			err = checkCodec(c.codec)
+			if err != nil {
+				break
+			}
+
+			if parts[0] == "tcp" {
+				addr, err = net.ResolveTCPAddr("tcp", rest[0])
+			} else {
+				addr, err = net.ResolveUnixAddr("unix", rest[0])
+			}
 		default:
 			err = fmt.Errorf("Unknown address type: %s", parts[0])
 		}
@@ -220,6 +352,64 @@ func (c *Client) Start() (net.Addr, error) {
 	return addr, nil
 }
 
+// createInstanceDir creates the per-instance working and temp directories
+// and points cmd at them. The working directory is only used if cmd has no
+// Dir of its own.
+func (c *Client) createInstanceDir(cmd *exec.Cmd) error {
+	setDir := cmd.Dir == ""
+	if setDir {
+		// A relative command path is resolved against cmd.Dir, which is
+		// about to change.
+		path, err := filepath.Abs(cmd.Path)
+		if err != nil {
+			return err
+		}
+		cmd.Path = path
+	}
+
+	dir, err := ioutil.TempDir(c.config.InstanceDir.Root, "plugin")
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	c.instanceDir = dir
+
+	workDir := filepath.Join(dir, "work")
+	tmpDir := filepath.Join(dir, "tmp")
+	for _, d := range []string{workDir, tmpDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			c.removeInstanceDir()
+			return err
+		}
+	}
+
+	if setDir {
+		cmd.Dir = workDir
+	}
+	cmd.Env = append(cmd.Env, "TMPDIR="+tmpDir)
+	return nil
+}
+
+// removeInstanceDir removes the per-instance directories, unless the plugin
+// crashed and they are kept for post-mortem debugging. Must be called with
+// the lock held.
+func (c *Client) removeInstanceDir() {
+	if c.instanceDir == "" {
+		return
+	}
+
+	if c.crashed && c.config.InstanceDir.KeepOnCrash {
+		c.logger.Println("plugin crashed, keeping instance dir", "path", c.instanceDir)
+	} else if err := os.RemoveAll(c.instanceDir); err != nil {
+		c.logger.Println("error removing instance dir", "path", c.instanceDir, "err", err)
+	}
+	c.instanceDir = ""
+}
+
 var stdErrBufferSize = 64 * 1024
 
 func (c *Client) logStderr(r io.Reader) {
@@ -303,6 +493,13 @@ func (c *Client) Kill() {
 		// killed.
 		c.l.Lock()
 		c.proc = nil
+		if c.pairConn != nil {
+			c.pairConn.Close()
+			c.pairConn = nil
+		}
+
+		// The process has exited, so its directories can go.
+		c.removeInstanceDir()
 		c.l.Unlock()
 	}()
 
@@ -343,11 +540,12 @@ func (c *Client) Kill() {
 		}
 	}
 
-	// If graceful exiting failed, just kill it
+	// If graceful exiting failed, just kill it. Flag it first so the exit
+	// isn't mistaken for a crash.
 	c.logger.Println("plugin failed to exit gracefully")
-	proc.Kill()
-
 	c.l.Lock()
 	c.procKilled = true
 	c.l.Unlock()
+
+	proc.Kill()
 }
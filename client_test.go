@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -79,6 +80,89 @@ func TestClient_testCleanup(t *testing.T) {
 	}
 }
 
+func TestClient_orphan(t *testing.T) {
+	td, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	// The host helper exits without killing its plugin, which writes this
+	// file once it has shut down cleanly.
+	path := filepath.Join(td, "output")
+	host := helperProcess("orphan-host", path)
+	if out, err := host.CombinedOutput(); err != nil {
+		t.Fatalf("err: %s\n%s", err, out)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("plugin didn't exit after its host died")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestClient_signalDrain(t *testing.T) {
+	td, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	path := filepath.Join(td, "output")
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("shutdown", path),
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	client := raw.(*testInterfaceClient).Client
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Call("Plugin.Sleep", 200*time.Millisecond, &struct{}{})
+	}()
+
+	// Interrupt the plugin while the call is in flight, like Ctrl-C in a
+	// terminal would.
+	time.Sleep(50 * time.Millisecond)
+	if err := c.proc.Signal(os.Interrupt); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("call in flight should finish, got %s", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for !c.Exited() {
+		select {
+		case <-timeout:
+			t.Fatal("plugin didn't exit after the signal")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("shutdown hook should have run: %s", err)
+	}
+}
+
 func TestClient_testInterface(t *testing.T) {
 	proc := helperProcess("test-interface")
 	c := NewClient(&ClientConfig{
@@ -121,6 +205,192 @@ func TestClient_testInterface(t *testing.T) {
 	}
 }
 
+func TestClient_bidirectional(t *testing.T) {
+	process := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:     process,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	impl := raw.(testInterface)
+
+	logger := new(testLoggerImpl)
+	if err := impl.Bidirectional(logger); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(logger.msgs, []string{"hello from the plugin"}) {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+}
+
+func TestClient_instanceDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	process := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:         process,
+		Plugins:     testPluginMap,
+		InstanceDir: &InstanceDirConfig{Root: td},
+	})
+	defer c.Kill()
+
+	if _, err := c.Protocol(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := c.instanceDir
+	if filepath.Dir(dir) != td {
+		t.Fatalf("bad instance dir: %s", dir)
+	}
+	if process.Dir != filepath.Join(dir, "work") {
+		t.Fatalf("bad working dir: %s", process.Dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("instance dir should be removed, got %v", err)
+	}
+}
+
+func TestClient_instanceDirKeepOnCrash(t *testing.T) {
+	td, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	process := helperProcess("crash")
+	c := NewClient(&ClientConfig{
+		Cmd:         process,
+		Plugins:     testPluginMap,
+		InstanceDir: &InstanceDirConfig{Root: td, KeepOnCrash: true},
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err == nil {
+		t.Fatal("err should not be nil")
+	}
+	dir := c.instanceDir
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Kill()
+
+	// The temp files of the crashed plugin are kept for inspection.
+	data, err := ioutil.ReadFile(filepath.Join(dir, "tmp", "crash"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("bad: %s", data)
+	}
+}
+
+func TestClient_instanceDirCmdDir(t *testing.T) {
+	td := t.TempDir()
+	wd := t.TempDir()
+
+	process := helperProcess("test-interface")
+	process.Dir = wd
+	c := NewClient(&ClientConfig{
+		Cmd:         process,
+		Plugins:     testPluginMap,
+		InstanceDir: &InstanceDirConfig{Root: td},
+	})
+	defer c.Kill()
+
+	if _, err := c.Protocol(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The working directory of the caller is kept.
+	if process.Dir != wd {
+		t.Fatalf("bad working dir: %s", process.Dir)
+	}
+	if _, err := os.Stat(filepath.Join(c.instanceDir, "tmp")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestClient_instanceDirStartError(t *testing.T) {
+	td := t.TempDir()
+
+	c := NewClient(&ClientConfig{
+		Cmd:         helperProcess("start-error"),
+		Plugins:     testPluginMap,
+		InstanceDir: &InstanceDirConfig{Root: td, KeepOnCrash: true},
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err == nil {
+		t.Fatal("err should not be nil")
+	}
+	dir := c.instanceDir
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Kill()
+
+	// A plugin that failed to start didn't crash.
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("instance dir should be removed, got %v", err)
+	}
+}
+
+func TestClient_dispenseWithArgs(t *testing.T) {
+	process := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:     process,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Every instance gets its own arguments.
+	for _, tenant := range []string{"tenant-a", "tenant-b"} {
+		raw, err := proto.DispenseWithArgs("args", tenant)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		var resp string
+		if err := raw.(Caller).Call("Plugin.Args", true, &resp); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if resp != tenant {
+			t.Fatalf("bad: %s", resp)
+		}
+	}
+
+	// Plugins that don't implement ServerWithArgs don't take any.
+	if _, err := proto.DispenseWithArgs("test", "tenant-a"); err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
+
 func TestClient_Start_timeout(t *testing.T) {
 	config := &ClientConfig{
 		Cmd:          helperProcess("start-timeout"),
@@ -137,6 +407,26 @@ func TestClient_Start_timeout(t *testing.T) {
 	}
 }
 
+func TestClient_Start_error(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("start-error"),
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	_, err := c.Start()
+	startErr, ok := err.(*PluginStartError)
+	if !ok {
+		t.Fatalf("expected a PluginStartError, got %#v", err)
+	}
+	if !strings.Contains(startErr.Message, "bogus") {
+		t.Fatalf("bad message: %s", startErr.Message)
+	}
+	if startErr.ExitCode != 1 {
+		t.Fatalf("bad exit code: %d", startErr.ExitCode)
+	}
+}
+
 func TestClient_Stderr(t *testing.T) {
 	stderr := new(bytes.Buffer)
 	process := helperProcess("stderr")
@@ -218,6 +508,63 @@ func TestClient_stdin(t *testing.T) {
 	}
 }
 
+func TestClient_info(t *testing.T) {
+	process := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:     process,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	info, err := proto.Info()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &PluginInfo{
+		Name:              "test",
+		Version:           "1.2.3",
+		Commit:            "abcdef",
+		PowerstripVersion: Version,
+		Labels:            map[string]string{"env": "test"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestClient_list(t *testing.T) {
+	process := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:     process,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	plugins, err := proto.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []PluginDescriptor{
+		{Name: "args"},
+		{Name: "test", Capabilities: map[string]string{"double": "int"}},
+	}
+	if !reflect.DeepEqual(plugins, expected) {
+		t.Fatalf("bad: %#v", plugins)
+	}
+}
+
 func TestClient_ping(t *testing.T) {
 	process := helperProcess("test-interface")
 	c := NewClient(&ClientConfig{
@@ -243,3 +590,57 @@ func TestClient_ping(t *testing.T) {
 		t.Fatal("should error")
 	}
 }
+
+func TestClient_jsonrpc(t *testing.T) {
+	process := helperProcess("test-jsonrpc")
+	c := NewClient(&ClientConfig{
+		Cmd:     process,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.codec != CodecJSONRPC {
+		t.Fatalf("bad codec: %s", c.codec)
+	}
+
+	if err := proto.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	raw, err := proto.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	impl, ok := raw.(testInterface)
+	if !ok {
+		t.Fatalf("bad: %#v", raw)
+	}
+	if result := impl.Double(21); result != 42 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Callbacks use the codec of the connection too.
+	logger := new(testLoggerImpl)
+	if err := impl.Bidirectional(logger); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logger.msgs) != 1 {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+
+	raw, err = proto.DispenseWithArgs("args", "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp string
+	if err := raw.(Caller).Call("Plugin.Args", true, &resp); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp != "foo" {
+		t.Fatalf("bad: %s", resp)
+	}
+}
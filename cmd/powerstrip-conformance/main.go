@@ -0,0 +1,48 @@
+// Command powerstrip-conformance checks that a plugin speaks the powerstrip
+// wire protocol. It starts the plugin, drives it through the conformance
+// suite and prints the outcome of every step.
+//
+// Usage:
+//
+//	powerstrip-conformance [-plugin name] [-timeout 10s] command [args...]
+//
+// It exits with status 1 if the plugin fails any step.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/zeroFruit/powerstrip/conformance"
+)
+
+func main() {
+	plugin := flag.String("plugin", "", "name of the plugin to dispense (default: the first one listed)")
+	timeout := flag.Duration("timeout", 0, "timeout of every step (default: 10s)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
+	cmd.Stderr = os.Stderr
+
+	report := conformance.Run(&conformance.Config{
+		Cmd:     cmd,
+		Plugin:  *plugin,
+		Timeout: *timeout,
+	})
+	fmt.Print(report)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// generatedHeader starts every generated file. Files starting with it are
+// skipped when loading the package, so that stale output never gets in the
+// way of generating it again.
+const generatedHeader = "// Code generated by powerstrip-gen. DO NOT EDIT."
+
+// powerstripPath is the import path of the powerstrip package.
+const powerstripPath = "github.com/zeroFruit/powerstrip"
+
+// reservedNames are the identifiers the generated methods use, which
+// parameters are renamed away from.
+var reservedNames = map[string]bool{
+	"c": true, "s": true, "args": true, "reply": true, "err": true,
+}
+
+// loadPackage parses and type-checks the Go package in dir.
+func loadPackage(dir string) (*types.Package, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bp.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		if isGenerated(f) {
+			continue
+		}
+		files = append(files, f)
+	}
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	return conf.Check(bp.ImportPath, fset, files, nil)
+}
+
+func isGenerated(f *ast.File) bool {
+	for _, c := range f.Comments {
+		if c.Pos() > f.Package {
+			break
+		}
+		if strings.HasPrefix(c.Text(), strings.TrimPrefix(generatedHeader, "// ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// generator writes the RPC boilerplate of interfaces of a package.
+type generator struct {
+	pkg *types.Package
+	buf bytes.Buffer
+
+	// imports are the packages the generated code refers to, by path.
+	imports map[string]string
+
+	// done holds the interfaces generated so far, and queue the callback
+	// interfaces that still have to be.
+	done  map[*types.Named]bool
+	queue []*types.Named
+}
+
+// iface is an interface to generate the boilerplate of.
+type iface struct {
+	name    string
+	methods []*method
+}
+
+type method struct {
+	name    string
+	params  []*param
+	results []*param
+	hasErr  bool
+}
+
+type param struct {
+	// name is the name of the parameter in the generated methods, and
+	// field its field in the args or reply struct.
+	name  string
+	field string
+	typ   string
+
+	// callback is the interface of a parameter that is served to the
+	// other side through the MuxBroker.
+	callback *types.Named
+}
+
+// generate returns the generated source for the interfaces typeNames of
+// pkg.
+func generate(pkg *types.Package, typeNames []string) ([]byte, error) {
+	g := &generator{
+		pkg:     pkg,
+		imports: map[string]string{powerstripPath: "powerstrip"},
+		done:    make(map[*types.Named]bool),
+	}
+
+	for _, name := range typeNames {
+		obj := pkg.Scope().Lookup(name)
+		if obj == nil {
+			return nil, fmt.Errorf("%s: type %s not found", pkg.Path(), name)
+		}
+		named, ok := obj.Type().(*types.Named)
+		if !ok || !types.IsInterface(named) {
+			return nil, fmt.Errorf("%s is not an interface", name)
+		}
+
+		it, err := g.load(named)
+		if err != nil {
+			return nil, err
+		}
+		g.done[named] = true
+		g.writeInterface(it)
+		g.writePlugin(it)
+	}
+
+	// Callback interfaces get everything but the plugin.
+	for len(g.queue) > 0 {
+		named := g.queue[0]
+		g.queue = g.queue[1:]
+		if g.done[named] {
+			continue
+		}
+		g.done[named] = true
+
+		it, err := g.load(named)
+		if err != nil {
+			return nil, err
+		}
+		g.writeInterface(it)
+		g.writeCallback(it)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s\n\npackage %s\n\n", generatedHeader, pkg.Name())
+	// The standard library goes first, like goimports does.
+	var std, other []string
+	for path := range g.imports {
+		if strings.Contains(strings.Split(path, "/")[0], ".") {
+			other = append(other, path)
+		} else {
+			std = append(std, path)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	out.WriteString("import (\n")
+	for i, paths := range [][]string{std, other} {
+		if i > 0 && len(std) > 0 && len(other) > 0 {
+			out.WriteString("\n")
+		}
+		for _, path := range paths {
+			if name := g.imports[path]; name != filepath.Base(path) {
+				fmt.Fprintf(&out, "\t%s %q\n", name, path)
+			} else {
+				fmt.Fprintf(&out, "\t%q\n", path)
+			}
+		}
+	}
+	out.WriteString(")\n")
+	out.Write(g.buf.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %s\n%s", err, out.Bytes())
+	}
+	return src, nil
+}
+
+// load reads the methods of the interface named.
+func (g *generator) load(named *types.Named) (*iface, error) {
+	name := named.Obj().Name()
+	if named.Obj().Pkg() != g.pkg {
+		return nil, fmt.Errorf("interface %s must be declared in package %s", named, g.pkg.Path())
+	}
+
+	it := &iface{name: name}
+	u := named.Underlying().(*types.Interface)
+	for i := 0; i < u.NumMethods(); i++ {
+		fn := u.Method(i)
+		sig := fn.Type().(*types.Signature)
+		if sig.Variadic() {
+			return nil, fmt.Errorf("%s.%s: variadic methods aren't supported", name, fn.Name())
+		}
+
+		m := &method{name: fn.Name()}
+		fields := make(map[string]bool)
+		for j := 0; j < sig.Params().Len(); j++ {
+			v := sig.Params().At(j)
+			p, err := g.param(v.Type(), true)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", name, fn.Name(), err)
+			}
+
+			p.name = v.Name()
+			if p.name == "" || p.name == "_" || reservedNames[p.name] {
+				p.name = fmt.Sprintf("arg%d", j)
+			}
+			p.field = exported(p.name)
+			if fields[p.field] {
+				p.field = fmt.Sprintf("Arg%d", j)
+			}
+			fields[p.field] = true
+			m.params = append(m.params, p)
+		}
+
+		results := sig.Results()
+		for j := 0; j < results.Len(); j++ {
+			t := results.At(j).Type()
+			if j == results.Len()-1 && types.Identical(t, errorType) {
+				m.hasErr = true
+				break
+			}
+			p, err := g.param(t, false)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", name, fn.Name(), err)
+			}
+			p.name = fmt.Sprintf("r%d", j)
+			p.field = fmt.Sprintf("Result%d", j)
+			m.results = append(m.results, p)
+		}
+		it.methods = append(it.methods, m)
+	}
+	return it, nil
+}
+
+var errorType = types.Universe.Lookup("error").Type()
+
+// param describes a parameter or result of type t.
+func (g *generator) param(t types.Type, isParam bool) (*param, error) {
+	p := &param{typ: types.TypeString(t, g.qualifier)}
+
+	if named, ok := t.(*types.Named); ok && types.IsInterface(t) && !types.Identical(t, errorType) {
+		if named.Underlying().(*types.Interface).NumMethods() > 0 {
+			if !isParam {
+				return nil, fmt.Errorf("interface result %s can't be sent across", p.typ)
+			}
+			p.callback = named
+			if !g.done[named] {
+				g.queue = append(g.queue, named)
+			}
+			return p, nil
+		}
+	}
+
+	switch t.Underlying().(type) {
+	case *types.Chan, *types.Signature:
+		return nil, fmt.Errorf("%s can't be sent across", p.typ)
+	}
+	return p, nil
+}
+
+func (g *generator) qualifier(pkg *types.Package) string {
+	if pkg == g.pkg {
+		return ""
+	}
+	g.imports[pkg.Path()] = pkg.Name()
+	return pkg.Name()
+}
+
+func exported(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// openStruct opens the body of a struct with n fields.
+func (g *generator) openStruct(n int) {
+	if n == 0 {
+		g.printf("{")
+	} else {
+		g.printf(" {\n")
+	}
+}
+
+// writeInterface writes the args and reply structs, the client and the
+// server of it.
+func (g *generator) writeInterface(it *iface) {
+	for _, m := range it.methods {
+		g.printf("\n// %s%sArgs are the arguments of %s.%s.\n", it.name, m.name, it.name, m.name)
+		g.printf("type %s%sArgs struct", it.name, m.name)
+		g.openStruct(len(m.params))
+		for _, p := range m.params {
+			if p.callback != nil {
+				g.printf("%s uint32 // broker ID of the %s callback\n", p.field, p.typ)
+			} else {
+				g.printf("%s %s\n", p.field, p.typ)
+			}
+		}
+		g.printf("}\n")
+
+		g.printf("\n// %s%sReply is the reply of %s.%s.\n", it.name, m.name, it.name, m.name)
+		g.printf("type %s%sReply struct", it.name, m.name)
+		g.openStruct(len(m.results))
+		for _, r := range m.results {
+			g.printf("%s %s\n", r.field, r.typ)
+		}
+		g.printf("}\n")
+	}
+
+	g.printf("\n// %sRPC is the client of %s. It implements %s by calling the\n", it.name, it.name, it.name)
+	g.printf("// other side.\n")
+	g.printf("type %sRPC struct {\n", it.name)
+	g.printf("client powerstrip.Caller\n")
+	g.printf("broker *powerstrip.MuxBroker\n")
+	g.printf("}\n")
+	for _, m := range it.methods {
+		g.writeClientMethod(it, m)
+	}
+
+	g.printf("\n// %sRPCServer serves Impl to a %sRPC.\n", it.name, it.name)
+	g.printf("type %sRPCServer struct {\n", it.name)
+	g.printf("Impl %s\n", it.name)
+	g.printf("broker *powerstrip.MuxBroker\n")
+	g.printf("}\n")
+	for _, m := range it.methods {
+		g.writeServerMethod(it, m)
+	}
+}
+
+func (g *generator) writeClientMethod(it *iface, m *method) {
+	var params, results []string
+	for _, p := range m.params {
+		params = append(params, p.name+" "+p.typ)
+	}
+	for _, r := range m.results {
+		results = append(results, r.typ)
+	}
+	if m.hasErr {
+		results = append(results, "error")
+	}
+
+	sig := fmt.Sprintf("%s(%s)", m.name, strings.Join(params, ", "))
+	switch len(results) {
+	case 0:
+	case 1:
+		sig += " " + results[0]
+	default:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+
+	g.printf("\nfunc (c *%sRPC) %s {\n", it.name, sig)
+	var fields []string
+	for _, p := range m.params {
+		if p.callback != nil {
+			// The callback is served for as long as the other side keeps
+			// the stream open, which is until the call returns.
+			g.printf("%sID := c.broker.NextId()\n", p.name)
+			g.printf("go c.broker.AcceptAndServe(%sID, \"Plugin\", &%sRPCServer{Impl: %s, broker: c.broker})\n",
+				p.name, p.callback.Obj().Name(), p.name)
+			fields = append(fields, fmt.Sprintf("%s: %sID", p.field, p.name))
+		} else {
+			fields = append(fields, fmt.Sprintf("%s: %s", p.field, p.name))
+		}
+	}
+	g.printf("var reply %s%sReply\n", it.name, m.name)
+	g.printf("err := c.client.Call(\"Plugin.%s\", &%s%sArgs{%s}, &reply)\n",
+		m.name, it.name, m.name, strings.Join(fields, ", "))
+
+	var returns []string
+	for _, r := range m.results {
+		returns = append(returns, "reply."+r.field)
+	}
+	if m.hasErr {
+		returns = append(returns, "err")
+	} else {
+		// There is no other way to report the error.
+		g.printf("if err != nil {\npanic(err)\n}\n")
+	}
+	if len(returns) > 0 {
+		g.printf("return %s\n", strings.Join(returns, ", "))
+	}
+	g.printf("}\n")
+}
+
+func (g *generator) writeServerMethod(it *iface, m *method) {
+	g.printf("\nfunc (s *%sRPCServer) %s(args *%s%sArgs, reply *%s%sReply) error {\n",
+		it.name, m.name, it.name, m.name, it.name, m.name)
+
+	var callArgs []string
+	errDeclared := false
+	for _, p := range m.params {
+		if p.callback == nil {
+			callArgs = append(callArgs, "args."+p.field)
+			continue
+		}
+		g.printf("%s, err := dial%sRPC(s.broker, args.%s)\n", p.name, p.callback.Obj().Name(), p.field)
+		errDeclared = true
+		g.printf("if err != nil {\nreturn err\n}\n")
+		g.printf("defer %s.client.Close()\n", p.name)
+		callArgs = append(callArgs, p.name)
+	}
+
+	var lhs []string
+	for _, r := range m.results {
+		lhs = append(lhs, "reply."+r.field)
+	}
+	call := fmt.Sprintf("s.Impl.%s(%s)", m.name, strings.Join(callArgs, ", "))
+	switch {
+	case m.hasErr && len(lhs) == 0:
+		g.printf("return %s\n", call)
+	case m.hasErr:
+		if !errDeclared {
+			g.printf("var err error\n")
+		}
+		g.printf("%s = %s\n", strings.Join(append(lhs, "err"), ", "), call)
+		g.printf("return err\n")
+	case len(lhs) > 0:
+		g.printf("%s = %s\n", strings.Join(lhs, ", "), call)
+		g.printf("return nil\n")
+	default:
+		g.printf("%s\n", call)
+		g.printf("return nil\n")
+	}
+	g.printf("}\n")
+}
+
+// writePlugin writes the powerstrip.Plugin of it.
+func (g *generator) writePlugin(it *iface) {
+	g.printf("\n// %sPlugin is the powerstrip.Plugin of %s. The plugin sets Impl, the\n", it.name, it.name)
+	g.printf("// host leaves it empty.\n")
+	g.printf("type %sPlugin struct {\n", it.name)
+	g.printf("Impl %s\n", it.name)
+	g.printf("}\n")
+
+	g.printf("\nfunc (p *%sPlugin) Server(b *powerstrip.MuxBroker) (interface{}, error) {\n", it.name)
+	g.printf("return &%sRPCServer{Impl: p.Impl, broker: b}, nil\n", it.name)
+	g.printf("}\n")
+
+	g.printf("\nfunc (%sPlugin) Client(b *powerstrip.MuxBroker, c powerstrip.Caller) (interface{}, error) {\n", it.name)
+	g.printf("return &%sRPC{client: c, broker: b}, nil\n", it.name)
+	g.printf("}\n")
+}
+
+// writeCallback writes the function that dials it as a callback through
+// the MuxBroker.
+func (g *generator) writeCallback(it *iface) {
+	g.printf("\n// dial%sRPC connects to the callback served on the broker stream id.\n", it.name)
+	g.printf("func dial%sRPC(b *powerstrip.MuxBroker, id uint32) (*%sRPC, error) {\n", it.name, it.name)
+	g.printf("client, err := b.DialRPC(id)\n")
+	g.printf("if err != nil {\n")
+	g.printf("return nil, err\n")
+	g.printf("}\n")
+	g.printf("return &%sRPC{client: client, broker: b}, nil\n", it.name)
+	g.printf("}\n")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestGenerate(t *testing.T) {
+	cases := []struct {
+		Dir   string
+		Types []string
+	}{
+		{"greeter", []string{"Greeter"}},
+		{"multi", []string{"Calc"}},
+		{"callback", []string{"Runner"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Dir, func(t *testing.T) {
+			dir := filepath.Join("testdata", tc.Dir)
+			pkg, err := loadPackage(dir)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			src, err := generate(pkg, tc.Types)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			golden := filepath.Join(dir, tc.Dir+"_rpc.go.golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, src, 0644); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !bytes.Equal(src, expected) {
+				t.Fatalf("output doesn't match %s, run with -update to see the difference:\n%s", golden, src)
+			}
+
+			testTypeCheck(t, dir, src)
+		})
+	}
+}
+
+// testTypeCheck checks that the package in dir builds with src added.
+func testTypeCheck(t *testing.T, dir string, src []byte) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var files []*ast.File
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			files = append(files, f)
+		}
+	}
+	generated, err := parser.ParseFile(fset, "generated.go", src, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files = append(files, generated)
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check(dir, fset, files, nil); err != nil {
+		t.Fatalf("generated code doesn't build: %s", err)
+	}
+}
+
+func TestGenerate_invalid(t *testing.T) {
+	pkg, err := loadPackage(filepath.Join("testdata", "invalid"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := map[string]string{
+		"Variadic":        "variadic methods aren't supported",
+		"Chan":            "chan string can't be sent across",
+		"InterfaceResult": "interface result Handle can't be sent across",
+		"Foreign":         "interface io.Reader must be declared in package",
+		"NotInterface":    "NotInterface is not an interface",
+		"Missing":         "type Missing not found",
+	}
+	for name, expected := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := generate(pkg, []string{name})
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("bad: %v", err)
+			}
+		})
+	}
+}
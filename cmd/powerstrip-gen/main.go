@@ -0,0 +1,79 @@
+// Command powerstrip-gen generates the RPC boilerplate of Go interfaces
+// served by powerstrip plugins.
+//
+// For every interface X given with -type, it generates
+//
+//   - XRPC, the client, which implements X by calling the plugin,
+//   - XRPCServer, which serves an implementation of X to XRPC,
+//   - the args and reply structs of every method of X,
+//   - XPlugin, the powerstrip.Plugin of X.
+//
+// Methods may take any number of arguments and return any number of
+// results, optionally followed by an error. Arguments of other interface
+// types of the same package are callbacks: they are served back to the
+// caller through the MuxBroker for the duration of the call, and get the
+// same boilerplate, minus the plugin.
+//
+// Usage:
+//
+//	powerstrip-gen -type Greeter[,Other] [-output file] [dir]
+//
+// It is meant to be run with go generate:
+//
+//	//go:generate powerstrip-gen -type Greeter
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of interface names")
+	output := flag.String("output", "", "output file name (default: <type>_rpc.go in dir)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s -type T[,T] [-output file] [dir]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *typeNames == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	types := strings.Split(*typeNames, ",")
+
+	if err := run(dir, types, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "powerstrip-gen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, typeNames []string, output string) error {
+	pkg, err := loadPackage(dir)
+	if err != nil {
+		return err
+	}
+
+	src, err := generate(pkg, typeNames)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = strings.ToLower(typeNames[0]) + "_rpc.go"
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(dir, output)
+	}
+	return ioutil.WriteFile(output, src, 0644)
+}
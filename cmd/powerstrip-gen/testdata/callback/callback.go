@@ -0,0 +1,10 @@
+package callback
+
+type Runner interface {
+	Run(name string, out Output) error
+}
+
+type Output interface {
+	Write(line string) error
+	Progress(done, total int)
+}
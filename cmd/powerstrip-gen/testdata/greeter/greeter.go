@@ -0,0 +1,6 @@
+package greeter
+
+type Greeter interface {
+	Greet() string
+	GreetName(name string) (string, error)
+}
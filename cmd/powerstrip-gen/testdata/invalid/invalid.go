@@ -0,0 +1,25 @@
+package invalid
+
+import "io"
+
+type Variadic interface {
+	Log(format string, args ...interface{})
+}
+
+type Chan interface {
+	Watch(ch chan string)
+}
+
+type InterfaceResult interface {
+	Open(name string) (Handle, error)
+}
+
+type Handle interface {
+	Close() error
+}
+
+type Foreign interface {
+	Copy(r io.Reader) error
+}
+
+type NotInterface struct{}
@@ -0,0 +1,11 @@
+package multi
+
+import "time"
+
+type Calc interface {
+	Add(a, b int) int
+	Div(a, b float64) (q float64, r float64, err error)
+	Reset() error
+	Log(_ string, args map[string]interface{})
+	Stamp(t time.Time) (time.Time, error)
+}
@@ -0,0 +1,436 @@
+package powerstrip
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"sync"
+)
+
+const (
+	// CodecGob is net/rpc's default gob codec. It is assumed if the plugin
+	// doesn't name a codec in its handshake.
+	CodecGob = "gob"
+
+	// CodecJSONRPC is the JSON-RPC 1.0 codec of net/rpc/jsonrpc, for
+	// plugins that aren't written in Go.
+	CodecJSONRPC = "jsonrpc"
+)
+
+// checkCodec returns an error if codec isn't a codec we speak.
+func checkCodec(codec string) error {
+	switch codec {
+	case CodecGob, CodecJSONRPC:
+		return nil
+	default:
+		return fmt.Errorf("unknown codec: %s", codec)
+	}
+}
+
+// newServerCodec returns the server side of codec on conn.
+func newServerCodec(codec string, conn io.ReadWriteCloser) (rpc.ServerCodec, error) {
+	switch codec {
+	case CodecGob, "":
+		return newGobServerCodec(conn), nil
+	case CodecJSONRPC:
+		return newJSONServerCodec(conn), nil
+	default:
+		return nil, checkCodec(codec)
+	}
+}
+
+// newCaller returns a Caller speaking codec on conn.
+func newCaller(codec string, conn io.ReadWriteCloser) (*rpcCaller, error) {
+	var cc metaClientCodec
+	switch codec {
+	case CodecGob, "":
+		cc = newGobClientCodec(conn)
+	case CodecJSONRPC:
+		cc = newJSONClientCodec(conn)
+	default:
+		return nil, checkCodec(codec)
+	}
+	return &rpcCaller{client: rpc.NewClientWithCodec(cc), codec: cc}, nil
+}
+
+// metaClientCodec is a rpc.ClientCodec that sends the metadata of calls
+// along with their request header, in fields that net/rpc and other
+// servers ignore. Calls still look like plain net/rpc calls on the wire.
+type metaClientCodec interface {
+	rpc.ClientCodec
+
+	// send calls fn, which sends a request, with meta as the metadata of
+	// that request.
+	send(meta callMeta, fn func())
+}
+
+// metaServerCodec is a rpc.ServerCodec that reads the metadata sent by a
+// metaClientCodec.
+type metaServerCodec interface {
+	rpc.ServerCodec
+
+	// requestMeta returns the metadata of the request whose header was
+	// read last.
+	requestMeta() callMeta
+}
+
+// nextMeta holds the metadata of the request a metaClientCodec writes
+// next. rpc.Client writes a request from the call to Go that makes it.
+type nextMeta struct {
+	lock sync.Mutex
+	meta callMeta
+}
+
+func (n *nextMeta) send(meta callMeta, fn func()) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.meta = meta
+	fn()
+	n.meta = callMeta{}
+}
+
+// gobRequestHeader is rpc.Request with the metadata of the call. gob
+// matches fields by name, so it decodes into a rpc.Request and the other
+// way around.
+type gobRequestHeader struct {
+	ServiceMethod string
+	Seq           uint64
+
+	CallID   uint64
+	Deadline int64
+}
+
+// newGobServerCodec returns the gob codec net/rpc uses by default. net/rpc
+// doesn't export it, and we need the codec itself to be able to wrap it.
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+// gobServerCodec is a copy of net/rpc's unexported gob server codec, which
+// reads the metadata of calls too.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+	meta   callMeta
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	var h gobRequestHeader
+	if err := c.dec.Decode(&h); err != nil {
+		return err
+	}
+	r.ServiceMethod, r.Seq = h.ServiceMethod, h.Seq
+	c.meta = newCallMeta(h.CallID, h.Deadline)
+	return nil
+}
+
+func (c *gobServerCodec) requestMeta() callMeta {
+	return c.meta
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header. Should not happen, so if it
+			// does, shut down the connection to signal that the connection
+			// is broken.
+			log.Println("[ERR] plugin: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been
+			// written. Shut down the connection to signal that the
+			// connection is broken.
+			log.Println("[ERR] plugin: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// gobClientCodec is a copy of net/rpc's unexported gob client codec, which
+// sends the metadata of calls too.
+type gobClientCodec struct {
+	nextMeta
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) *gobClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobClientCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	h := &gobRequestHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		CallID:        c.meta.id,
+	}
+	if !c.meta.deadline.IsZero() {
+		h.Deadline = c.meta.deadline.UnixNano()
+	}
+	if err = c.enc.Encode(h); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// jsonCallMeta is the metadata of a call, as the "meta" member of a
+// JSON-RPC request. Servers that don't know it ignore it.
+type jsonCallMeta struct {
+	Call     uint64 `json:"call,omitempty"`
+	Deadline int64  `json:"deadline,omitempty"`
+}
+
+var errMissingParams = errors.New("jsonrpc: request body missing params")
+
+// jsonServerCodec is a copy of net/rpc/jsonrpc's unexported server codec,
+// which reads the metadata of calls too.
+type jsonServerCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	req jsonServerRequest
+
+	// JSON-RPC request IDs can be any JSON value, so the requests are
+	// numbered, and pending maps the numbers to the original IDs. It and
+	// seq are protected by lock.
+	lock    sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+}
+
+func newJSONServerCodec(conn io.ReadWriteCloser) *jsonServerCodec {
+	return &jsonServerCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]*json.RawMessage),
+	}
+}
+
+type jsonServerRequest struct {
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+	ID     *json.RawMessage `json:"id"`
+	Meta   *jsonCallMeta    `json:"meta"`
+}
+
+type jsonServerResponse struct {
+	ID     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = jsonServerRequest{}
+	if err := c.dec.Decode(&c.req); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.req.Method
+
+	c.lock.Lock()
+	c.seq++
+	c.pending[c.seq] = c.req.ID
+	c.req.ID = nil
+	r.Seq = c.seq
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *jsonServerCodec) requestMeta() callMeta {
+	if c.req.Meta == nil {
+		return callMeta{}
+	}
+	return newCallMeta(c.req.Meta.Call, c.req.Meta.Deadline)
+}
+
+func (c *jsonServerCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.req.Params == nil {
+		return errMissingParams
+	}
+	// The params are an array holding the argument.
+	params := [1]interface{}{x}
+	return json.Unmarshal(*c.req.Params, &params)
+}
+
+func (c *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.lock.Lock()
+	id, ok := c.pending[r.Seq]
+	if !ok {
+		c.lock.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.lock.Unlock()
+
+	if id == nil {
+		// An invalid request has no ID.
+		null := json.RawMessage("null")
+		id = &null
+	}
+	resp := jsonServerResponse{ID: id}
+	if r.Error == "" {
+		resp.Result = x
+	} else {
+		resp.Error = r.Error
+	}
+	return c.enc.Encode(resp)
+}
+
+func (c *jsonServerCodec) Close() error {
+	return c.c.Close()
+}
+
+// jsonClientCodec is a copy of net/rpc/jsonrpc's unexported client codec,
+// which sends the metadata of calls too.
+type jsonClientCodec struct {
+	nextMeta
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	resp jsonClientResponse
+
+	// JSON-RPC responses don't name the method of the request, so pending
+	// maps the request IDs to them. It is protected by lock.
+	lock    sync.Mutex
+	pending map[uint64]string
+}
+
+func newJSONClientCodec(conn io.ReadWriteCloser) *jsonClientCodec {
+	return &jsonClientCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]string),
+	}
+}
+
+type jsonClientRequest struct {
+	Method string         `json:"method"`
+	Params [1]interface{} `json:"params"`
+	ID     uint64         `json:"id"`
+	Meta   *jsonCallMeta  `json:"meta,omitempty"`
+}
+
+type jsonClientResponse struct {
+	ID     uint64           `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+func (c *jsonClientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	c.lock.Lock()
+	c.pending[r.Seq] = r.ServiceMethod
+	c.lock.Unlock()
+
+	req := &jsonClientRequest{
+		Method: r.ServiceMethod,
+		Params: [1]interface{}{param},
+		ID:     r.Seq,
+	}
+	if c.meta.id != 0 || !c.meta.deadline.IsZero() {
+		req.Meta = &jsonCallMeta{Call: c.meta.id}
+		if !c.meta.deadline.IsZero() {
+			req.Meta.Deadline = c.meta.deadline.UnixNano()
+		}
+	}
+	return c.enc.Encode(req)
+}
+
+func (c *jsonClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.resp = jsonClientResponse{}
+	if err := c.dec.Decode(&c.resp); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	r.ServiceMethod = c.pending[c.resp.ID]
+	delete(c.pending, c.resp.ID)
+	c.lock.Unlock()
+
+	r.Error = ""
+	r.Seq = c.resp.ID
+	if c.resp.Error != nil || c.resp.Result == nil {
+		msg, ok := c.resp.Error.(string)
+		if !ok {
+			return fmt.Errorf("invalid error %v", c.resp.Error)
+		}
+		if msg == "" {
+			msg = "unspecified error"
+		}
+		r.Error = msg
+	}
+	return nil
+}
+
+func (c *jsonClientCodec) ReadResponseBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	return json.Unmarshal(*c.resp.Result, x)
+}
+
+func (c *jsonClientCodec) Close() error {
+	return c.c.Close()
+}
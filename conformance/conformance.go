@@ -0,0 +1,366 @@
+package conformance
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The steps of the suite, in the order they run. Every step needs the ones
+// before it to pass.
+const (
+	StepHandshake     = "handshake"
+	StepConnect       = "connect"
+	StepControlStream = "control-stream"
+	StepStdioStreams  = "stdio-streams"
+	StepPing          = "control-ping"
+	StepList          = "dispenser-list"
+	StepDispense      = "dispense"
+	StepBrokerDial    = "broker-dial"
+	StepRelease       = "release"
+	StepQuit          = "quit"
+)
+
+// Config configures a conformance run.
+type Config struct {
+	// Cmd starts the plugin. Its Stdout must not be set, since the
+	// handshake is read from it.
+	Cmd *exec.Cmd
+
+	// Plugin is the name of the plugin to dispense. It defaults to the
+	// first plugin Dispenser.List returns.
+	Plugin string
+
+	// Timeout bounds every step. It defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Result is the outcome of a step.
+type Result struct {
+	Step string
+
+	// Err is why the step failed, or nil if it passed.
+	Err error
+
+	// Skipped is set if the step didn't run because an earlier one
+	// failed.
+	Skipped bool
+}
+
+// Report is the outcome of a conformance run.
+type Report struct {
+	Results []Result
+}
+
+// Failed reports whether any step failed.
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Err != nil || res.Skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// Result returns the result of step, if it is part of the report.
+func (r *Report) Result(step string) (Result, bool) {
+	for _, res := range r.Results {
+		if res.Step == step {
+			return res, true
+		}
+	}
+	return Result{}, false
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, res := range r.Results {
+		switch {
+		case res.Skipped:
+			fmt.Fprintf(&b, "SKIP %s\n", res.Step)
+		case res.Err != nil:
+			fmt.Fprintf(&b, "FAIL %s: %s\n", res.Step, res.Err)
+		default:
+			fmt.Fprintf(&b, "PASS %s\n", res.Step)
+		}
+	}
+	return b.String()
+}
+
+// Run drives the plugin started by config.Cmd through the protocol and
+// reports the steps it passed. The plugin is killed if it is still running
+// at the end.
+func Run(config *Config) *Report {
+	r := &runner{config: config}
+	if r.config.Timeout == 0 {
+		r.config.Timeout = 10 * time.Second
+	}
+	defer r.cleanup()
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{StepHandshake, r.handshake},
+		{StepConnect, r.connect},
+		{StepControlStream, r.controlStream},
+		{StepStdioStreams, r.stdioStreams},
+		{StepPing, r.ping},
+		{StepList, r.list},
+		{StepDispense, r.dispense},
+		{StepBrokerDial, r.brokerDial},
+		{StepRelease, r.release},
+		{StepQuit, r.quit},
+	}
+
+	report := new(Report)
+	failed := false
+	for _, step := range steps {
+		if failed {
+			report.Results = append(report.Results, Result{Step: step.name, Skipped: true})
+			continue
+		}
+
+		err := step.fn()
+		if r.session != nil {
+			if v := r.session.takeViolations(); len(v) > 0 && err == nil {
+				err = fmt.Errorf("protocol violations: %s", strings.Join(v, "; "))
+			}
+		}
+		report.Results = append(report.Results, Result{Step: step.name, Err: err})
+		failed = err != nil
+	}
+	return report
+}
+
+// runner holds the state a run builds up from step to step.
+type runner struct {
+	config *Config
+
+	waitCh  chan error
+	network string
+	address string
+	codec   string
+
+	session *session
+	control *rpc.Client
+	plugin  string
+	id      uint32
+	stream  *stream
+}
+
+func (r *runner) handshake() error {
+	cmd := r.config.Cmd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	r.waitCh = make(chan error, 1)
+	go func() {
+		r.waitCh <- cmd.Wait()
+	}()
+
+	lineCh := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		lineCh <- line
+		// Keep draining stdout, so the plugin never blocks on it.
+		io.Copy(ioutil.Discard, stdout)
+	}()
+
+	var line string
+	select {
+	case line = <-lineCh:
+	case err := <-r.waitCh:
+		return fmt.Errorf("plugin exited before the handshake: %v", err)
+	case <-time.After(r.config.Timeout):
+		return fmt.Errorf("no handshake within %s", r.config.Timeout)
+	}
+
+	if !strings.HasSuffix(line, "\n") {
+		return fmt.Errorf("handshake isn't a complete line: %q", line)
+	}
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if parts[0] == "error" && len(parts) >= 2 {
+		return fmt.Errorf("plugin reported a start error: %s", strings.Join(parts[1:], "|"))
+	}
+	if len(parts) != 2 && len(parts) != 3 {
+		return fmt.Errorf("malformed handshake: %q", line)
+	}
+
+	r.network, r.address, r.codec = parts[0], parts[1], "gob"
+	if len(parts) == 3 {
+		r.codec = parts[2]
+	}
+	switch r.network {
+	case "unix", "tcp":
+	default:
+		return fmt.Errorf("unknown network %q", r.network)
+	}
+	switch r.codec {
+	case "gob", "jsonrpc":
+	default:
+		return fmt.Errorf("unknown codec %q", r.codec)
+	}
+	return nil
+}
+
+func (r *runner) connect() error {
+	conn, err := net.DialTimeout(r.network, r.address, r.config.Timeout)
+	if err != nil {
+		return err
+	}
+	r.session = newSession(conn, r.config.Timeout)
+	return nil
+}
+
+func (r *runner) controlStream() error {
+	st, err := r.session.open()
+	if err != nil {
+		return err
+	}
+	if r.codec == "jsonrpc" {
+		r.control = jsonrpc.NewClient(st)
+	} else {
+		r.control = rpc.NewClient(st)
+	}
+	return nil
+}
+
+func (r *runner) stdioStreams() error {
+	for _, name := range []string{"stdout", "stderr"} {
+		st, err := r.session.open()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		go st.drain()
+	}
+	return nil
+}
+
+// call calls method on the control stream, giving up after the timeout.
+func (r *runner) call(method string, args, reply interface{}) error {
+	call := r.control.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return fmt.Errorf("%s: %s", method, call.Error)
+		}
+		return nil
+	case <-time.After(r.config.Timeout):
+		return fmt.Errorf("%s: no response within %s", method, r.config.Timeout)
+	}
+}
+
+func (r *runner) ping() error {
+	var empty struct{}
+	return r.call("Control.Ping", true, &empty)
+}
+
+// descriptor is the wire form of a plugin in the Dispenser.List response.
+type descriptor struct {
+	Name         string
+	Capabilities map[string]string
+}
+
+func (r *runner) list() error {
+	var plugins []descriptor
+	if err := r.call("Dispenser.List", true, &plugins); err != nil {
+		return err
+	}
+	for i, p := range plugins {
+		if i > 0 && plugins[i-1].Name >= p.Name {
+			return fmt.Errorf("plugins aren't sorted by name: %q before %q", plugins[i-1].Name, p.Name)
+		}
+	}
+
+	r.plugin = r.config.Plugin
+	if r.plugin == "" {
+		if len(plugins) == 0 {
+			return errors.New("no plugins to dispense")
+		}
+		r.plugin = plugins[0].Name
+	}
+	for _, p := range plugins {
+		if p.Name == r.plugin {
+			return nil
+		}
+	}
+	return fmt.Errorf("plugin %q isn't listed", r.plugin)
+}
+
+func (r *runner) dispense() error {
+	if err := r.call("Dispenser.Dispense", r.plugin, &r.id); err != nil {
+		return err
+	}
+	if r.id == 0 {
+		return errors.New("dispensed broker ID 0")
+	}
+	return nil
+}
+
+func (r *runner) brokerDial() error {
+	st, err := r.session.open()
+	if err != nil {
+		return err
+	}
+	r.stream = st
+
+	if err := binary.Write(st, binary.LittleEndian, r.id); err != nil {
+		return err
+	}
+	var ack uint32
+	if err := binary.Read(st, binary.LittleEndian, &ack); err != nil {
+		return fmt.Errorf("reading ack: %s", err)
+	}
+	if ack != r.id {
+		return fmt.Errorf("bad ack %d, expected %d", ack, r.id)
+	}
+	return nil
+}
+
+func (r *runner) release() error {
+	// Closing the brokered stream releases the implementation, and the
+	// plugin must close its side in turn.
+	if err := r.stream.Close(); err != nil {
+		return err
+	}
+	return r.stream.waitFinished()
+}
+
+func (r *runner) quit() error {
+	var empty struct{}
+	if err := r.call("Control.Quit", true, &empty); err != nil {
+		return err
+	}
+
+	select {
+	case <-r.waitCh:
+		r.waitCh = nil
+		return nil
+	case <-time.After(r.config.Timeout):
+		return fmt.Errorf("plugin still running %s after Control.Quit", r.config.Timeout)
+	}
+}
+
+func (r *runner) cleanup() {
+	if r.session != nil {
+		r.session.Close()
+	}
+	if r.waitCh != nil {
+		r.config.Cmd.Process.Kill()
+		<-r.waitCh
+	}
+}
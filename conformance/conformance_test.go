@@ -0,0 +1,166 @@
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeroFruit/powerstrip"
+)
+
+// testGreeter is the implementation the helper plugins dispense.
+type testGreeter struct{}
+
+func (g *testGreeter) Greet(name string, resp *string) error {
+	*resp = "Hello " + name
+	return nil
+}
+
+type testGreeterPlugin struct{}
+
+func (p *testGreeterPlugin) Server(b *powerstrip.MuxBroker) (interface{}, error) {
+	return new(testGreeter), nil
+}
+
+func (p *testGreeterPlugin) Client(b *powerstrip.MuxBroker, c powerstrip.Caller) (interface{}, error) {
+	return c, nil
+}
+
+func helperProcess(s ...string) *exec.Cmd {
+	cs := []string{"-test.run=TestHelperProcess", "--"}
+	cs = append(cs, s...)
+	cmd := exec.Command(os.Args[0], cs...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+// This is not a real test. This is just a helper process kicked off by
+// tests.
+func TestHelperProcess(*testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+
+	cmd := args[0]
+	switch cmd {
+	case "gob", "jsonrpc":
+		powerstrip.Serve(&powerstrip.ServeConfig{
+			Plugins: powerstrip.PluginSet{
+				"greeter": new(testGreeterPlugin),
+			},
+			Codec: cmd,
+		})
+	case "bad-handshake":
+		fmt.Println("carrier-pigeon|coop")
+	case "start-error":
+		fmt.Println("error|no config")
+		os.Exit(1)
+	case "bad-frame":
+		// Handshake properly, but acknowledge the first stream with a
+		// made up frame version.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Printf("tcp|%s|gob\n", l.Addr())
+
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		var h header
+		if _, err := io.ReadFull(conn, h[:]); err != nil {
+			os.Exit(1)
+		}
+		h.encode(typeWindowUpdate, flagACK, h.streamID(), 0)
+		h[0] = 7
+		conn.Write(h[:])
+		time.Sleep(time.Minute)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n", cmd)
+		os.Exit(2)
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, codec := range []string{"gob", "jsonrpc"} {
+		t.Run(codec, func(t *testing.T) {
+			report := Run(&Config{
+				Cmd:     helperProcess(codec),
+				Timeout: 5 * time.Second,
+			})
+			if report.Failed() {
+				t.Fatalf("bad:\n%s", report)
+			}
+			if len(report.Results) != 10 {
+				t.Fatalf("bad:\n%s", report)
+			}
+		})
+	}
+}
+
+func TestRun_unknownPlugin(t *testing.T) {
+	report := Run(&Config{
+		Cmd:     helperProcess("gob"),
+		Plugin:  "nope",
+		Timeout: 5 * time.Second,
+	})
+
+	res, _ := report.Result(StepList)
+	if res.Err == nil {
+		t.Fatalf("bad:\n%s", report)
+	}
+	res, _ = report.Result(StepDispense)
+	if !res.Skipped {
+		t.Fatalf("bad:\n%s", report)
+	}
+}
+
+func TestRun_badHandshake(t *testing.T) {
+	for _, cmd := range []string{"bad-handshake", "start-error"} {
+		t.Run(cmd, func(t *testing.T) {
+			report := Run(&Config{
+				Cmd:     helperProcess(cmd),
+				Timeout: 5 * time.Second,
+			})
+
+			res, _ := report.Result(StepHandshake)
+			if res.Err == nil {
+				t.Fatalf("bad:\n%s", report)
+			}
+			for _, res := range report.Results[1:] {
+				if !res.Skipped {
+					t.Fatalf("bad:\n%s", report)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_badFrame(t *testing.T) {
+	report := Run(&Config{
+		Cmd:     helperProcess("bad-frame"),
+		Timeout: time.Second,
+	})
+
+	res, _ := report.Result(StepControlStream)
+	if res.Err == nil || !strings.Contains(res.Err.Error(), "version 7") {
+		t.Fatalf("bad:\n%s", report)
+	}
+}
@@ -0,0 +1,51 @@
+// Package conformance checks that a plugin process speaks the powerstrip
+// wire protocol. It drives the plugin as a host would, with its own
+// implementation of the protocol, and reports every step the plugin
+// violates. The Go implementation and ports to other languages are checked
+// against the same suite.
+//
+// The protocol is made of the following layers.
+//
+// Handshake. The host starts the plugin and reads the first line of its
+// stdout, which is one of
+//
+//	<network>|<address>|<codec>
+//	error|<message>
+//
+// network is "unix" or "tcp", and codec is "gob" or "jsonrpc". codec may
+// be left out, in which case it is "gob". The error form reports that the
+// plugin failed to start, after which it exits.
+//
+// Multiplexing. The host connects to the address and runs a multiplexed
+// session over the connection, as the client. Every frame starts with a 12
+// byte header, in big endian:
+//
+//	version   uint8   always 0
+//	type      uint8   0 data, 1 window update, 2 ping, 3 go away
+//	flags     uint16  1 SYN, 2 ACK, 4 FIN, 8 RST
+//	stream id uint32  odd for streams the host opens, even for the plugin
+//	length    uint32
+//
+// Data frames are followed by length bytes of payload. For window updates
+// length is the window delta, for pings an opaque value echoed back with
+// ACK, and for go away the error code. Pings and go away use stream 0. A
+// stream is opened with SYN and acknowledged with ACK, usually on a window
+// update, and half-closed with FIN. Every stream starts with a receive
+// window of 256KB, which the receiver grows with window updates as it
+// consumes data.
+//
+// Streams. The host opens the control stream first, then the stdout and
+// stderr streams, on which the plugin writes its output. The control
+// stream serves the Control and Dispenser services with the codec of the
+// handshake.
+//
+// Broker. Dispenser.Dispense returns a broker ID. The host opens a new
+// stream, writes the ID as a little endian uint32 and reads it back as an
+// ack. The dispensed implementation is then served on that stream as
+// "Plugin", until the host closes it. Either side can serve more streams
+// the same way, for callbacks. The host serves its host services on broker
+// IDs from 2^31 up, and passes them to the plugin right after connecting,
+// with a Control.HostServices call whose argument maps their names to their
+// IDs. The plugin may open any number of streams to them. A host without
+// host services doesn't make the call.
+package conformance
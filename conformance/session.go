@@ -0,0 +1,435 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The frame format, as described in the package documentation. It is
+// spelled out here rather than taken from the mux package, so that the
+// harness checks the format instead of agreeing with itself.
+const (
+	protoVersion = 0
+
+	typeData         = 0
+	typeWindowUpdate = 1
+	typePing         = 2
+	typeGoAway       = 3
+
+	flagSYN = 1
+	flagACK = 2
+	flagFIN = 4
+	flagRST = 8
+
+	headerSize    = 12
+	initialWindow = 256 * 1024
+)
+
+type header [headerSize]byte
+
+func (h *header) encode(msgType uint8, flags uint16, id, length uint32) {
+	h[0] = protoVersion
+	h[1] = msgType
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h *header) version() uint8   { return h[0] }
+func (h *header) msgType() uint8   { return h[1] }
+func (h *header) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h *header) streamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h *header) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+func (h *header) String() string {
+	return fmt.Sprintf("version %d type %d flags %d stream %d length %d",
+		h.version(), h.msgType(), h.flags(), h.streamID(), h.length())
+}
+
+var errSessionClosed = errors.New("session closed")
+
+// session is the host side of a multiplexed session. It only does what
+// the harness needs, and records every frame the plugin gets wrong as a
+// violation.
+type session struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	writeLock sync.Mutex
+
+	lock       sync.Mutex
+	streams    map[uint32]*stream
+	nextID     uint32
+	violations []string
+	goAway     bool
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	readErr   error
+}
+
+func newSession(conn net.Conn, timeout time.Duration) *session {
+	s := &session{
+		conn:    conn,
+		timeout: timeout,
+		streams: make(map[uint32]*stream),
+		nextID:  1,
+		closeCh: make(chan struct{}),
+	}
+	go s.recv()
+	return s
+}
+
+// takeViolations returns the violations recorded since the last call.
+func (s *session) takeViolations() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := s.violations
+	s.violations = nil
+	return v
+}
+
+func (s *session) violate(format string, args ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.violations = append(s.violations, fmt.Sprintf(format, args...))
+}
+
+func (s *session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	return s.conn.Close()
+}
+
+// sendData sends a data frame with body on stream id.
+func (s *session) sendData(id uint32, body []byte) error {
+	var h header
+	h.encode(typeData, 0, id, uint32(len(body)))
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(body)
+	return err
+}
+
+func (s *session) sendHeader(msgType uint8, flags uint16, id, length uint32) error {
+	var h header
+	h.encode(msgType, flags, id, length)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := s.conn.Write(h[:])
+	return err
+}
+
+// open opens a stream and waits for the plugin to acknowledge it.
+func (s *session) open() (*stream, error) {
+	s.lock.Lock()
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.sendHeader(typeWindowUpdate, flagSYN, id, 0); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-st.ackCh:
+		return st, nil
+	case <-s.closeCh:
+		return nil, s.err()
+	case <-time.After(s.timeout):
+		return nil, fmt.Errorf("stream %d: no ACK within %s", id, s.timeout)
+	}
+}
+
+func (s *session) err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.readErr != nil {
+		return s.readErr
+	}
+	return errSessionClosed
+}
+
+// recv reads the frames the plugin sends until the connection is closed.
+func (s *session) recv() {
+	err := s.recvLoop()
+
+	s.lock.Lock()
+	s.readErr = err
+	streams := make([]*stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.lock.Unlock()
+
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	for _, st := range streams {
+		st.notify()
+	}
+}
+
+func (s *session) recvLoop() error {
+	for {
+		var h header
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			return err
+		}
+
+		if h.version() != protoVersion {
+			s.violate("frame with version %d: %s", h.version(), &h)
+			return fmt.Errorf("bad frame version %d", h.version())
+		}
+		if h.flags()&^(flagSYN|flagACK|flagFIN|flagRST) != 0 {
+			s.violate("frame with unknown flags: %s", &h)
+		}
+
+		switch h.msgType() {
+		case typeData, typeWindowUpdate:
+			if err := s.handleStreamFrame(&h); err != nil {
+				return err
+			}
+		case typePing:
+			if h.streamID() != 0 {
+				s.violate("ping on stream %d", h.streamID())
+			}
+			if h.flags()&flagSYN != 0 {
+				s.sendHeader(typePing, flagACK, 0, h.length())
+			}
+		case typeGoAway:
+			if h.streamID() != 0 {
+				s.violate("go away on stream %d", h.streamID())
+			}
+			s.lock.Lock()
+			s.goAway = true
+			s.lock.Unlock()
+		default:
+			s.violate("frame with unknown type %d: %s", h.msgType(), &h)
+			return fmt.Errorf("bad frame type %d", h.msgType())
+		}
+	}
+}
+
+func (s *session) handleStreamFrame(h *header) error {
+	var body []byte
+	if h.msgType() == typeData && h.length() > 0 {
+		if h.length() > initialWindow {
+			s.violate("data frame larger than the stream window: %s", h)
+			return fmt.Errorf("data frame too large")
+		}
+		body = make([]byte, h.length())
+		if _, err := io.ReadFull(s.conn, body); err != nil {
+			return err
+		}
+	}
+
+	id := h.streamID()
+	flags := h.flags()
+
+	s.lock.Lock()
+	st, ok := s.streams[id]
+	s.lock.Unlock()
+
+	if flags&flagSYN != 0 {
+		if id%2 != 0 {
+			s.violate("plugin opened stream %d, which has a host stream id", id)
+		} else if ok {
+			s.violate("plugin opened stream %d twice", id)
+		}
+
+		// The suite doesn't serve callbacks or host services, which
+		// are the only streams the plugin opens, so turn them down.
+		s.sendHeader(typeWindowUpdate, flagRST, id, 0)
+		return nil
+	}
+	if !ok {
+		if flags&(flagFIN|flagRST) == 0 {
+			s.violate("frame for unknown stream: %s", h)
+		}
+		return nil
+	}
+
+	st.handle(h, body)
+	return nil
+}
+
+// stream is a stream the harness opened.
+type stream struct {
+	s  *session
+	id uint32
+
+	ackCh   chan struct{}
+	ackOnce sync.Once
+
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	recvBytes uint32
+	fin       bool
+	rst       bool
+	notifyCh  chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newStream(s *session, id uint32) *stream {
+	return &stream{
+		s:        s,
+		id:       id,
+		ackCh:    make(chan struct{}),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (st *stream) notify() {
+	select {
+	case st.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (st *stream) handle(h *header, body []byte) {
+	flags := h.flags()
+	if flags&flagACK != 0 {
+		st.ackOnce.Do(func() {
+			close(st.ackCh)
+		})
+	}
+
+	st.lock.Lock()
+	if len(body) > 0 {
+		if st.fin {
+			st.s.violate("stream %d: data after FIN", st.id)
+		}
+		st.recvBytes += uint32(len(body))
+		if st.recvBytes > initialWindow {
+			st.s.violate("stream %d: plugin sent beyond the receive window", st.id)
+		}
+		st.buf.Write(body)
+	}
+	if flags&flagFIN != 0 {
+		st.fin = true
+	}
+	if flags&flagRST != 0 {
+		st.rst = true
+	}
+	st.lock.Unlock()
+
+	st.notify()
+}
+
+// finished reports whether the plugin closed its side of the stream.
+func (st *stream) finished() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.fin || st.rst
+}
+
+// waitFinished waits for the plugin to close its side of the stream.
+func (st *stream) waitFinished() error {
+	timeout := time.After(st.s.timeout)
+	for {
+		if st.finished() {
+			return nil
+		}
+		select {
+		case <-st.notifyCh:
+		case <-st.s.closeCh:
+			if st.finished() {
+				return nil
+			}
+			return st.s.err()
+		case <-timeout:
+			return fmt.Errorf("stream %d: not closed within %s", st.id, st.s.timeout)
+		}
+	}
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	timeout := time.After(st.s.timeout)
+	for {
+		st.lock.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.lock.Unlock()
+
+			// Give the window back as soon as the data is consumed.
+			st.s.sendHeader(typeWindowUpdate, 0, st.id, uint32(n))
+			st.lock.Lock()
+			st.recvBytes -= uint32(n)
+			st.lock.Unlock()
+			return n, nil
+		}
+		if st.fin || st.rst {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		st.lock.Unlock()
+
+		select {
+		case <-st.notifyCh:
+		case <-st.s.closeCh:
+			st.notify()
+			st.lock.Lock()
+			empty := st.buf.Len() == 0
+			st.lock.Unlock()
+			if empty {
+				return 0, st.s.err()
+			}
+		case <-timeout:
+			return 0, fmt.Errorf("stream %d: no data within %s", st.id, st.s.timeout)
+		}
+	}
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	// The harness only sends small messages, which always fit in the
+	// initial window.
+	if err := st.s.sendData(st.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// drain reads and discards whatever the plugin writes on the stream, until
+// the stream or the session is closed.
+func (st *stream) drain() {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := st.Read(buf); err != nil {
+			select {
+			case <-st.s.closeCh:
+				return
+			default:
+			}
+			if err == io.EOF {
+				return
+			}
+		}
+	}
+}
+
+// Close half-closes the stream.
+func (st *stream) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		err = st.s.sendHeader(typeWindowUpdate, flagFIN, st.id, 0)
+	})
+	return err
+}
@@ -0,0 +1,349 @@
+package powerstrip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// DispenseMode is how a plugin's server implementations are handed out.
+type DispenseMode int
+
+const (
+	// DispenseNew creates a new implementation for every Dispense.
+	DispenseNew DispenseMode = iota
+
+	// DispenseSingleton creates a single implementation that is shared by
+	// every Dispense on a connection, each served over its own broker
+	// stream.
+	DispenseSingleton
+
+	// DispensePool creates a fixed number of implementations per
+	// connection up front. Every Dispense takes one out of the pool until
+	// it is released.
+	DispensePool
+)
+
+// DispensePolicy configures how a plugin's server implementations are
+// handed out.
+type DispensePolicy struct {
+	Mode DispenseMode
+
+	// PoolSize is the number of implementations in a DispensePool pool.
+	PoolSize int
+
+	// PoolTimeout is how long Dispense waits for a pooled implementation
+	// to be released before failing with a PoolExhaustedError. Zero fails
+	// right away.
+	PoolTimeout time.Duration
+}
+
+// DispensePolicyPlugin is implemented by plugins that aren't dispensed with
+// DispenseNew. WithDispensePolicy adds a policy to an existing plugin.
+//
+// Shared implementations belong to the connection they were dispensed on.
+// They aren't closed on release, but once that connection is gone or the
+// plugin shuts down. They can't be dispensed with arguments.
+type DispensePolicyPlugin interface {
+	Plugin
+
+	DispensePolicy() DispensePolicy
+}
+
+// WithDispensePolicy returns p with the given dispense policy, to be used
+// as an entry of a PluginSet.
+func WithDispensePolicy(p Plugin, policy DispensePolicy) Plugin {
+	return &policyPlugin{Plugin: p, policy: policy}
+}
+
+// policyPlugin adds a dispense policy to a plugin.
+type policyPlugin struct {
+	Plugin
+	policy DispensePolicy
+}
+
+func (p *policyPlugin) DispensePolicy() DispensePolicy {
+	return p.policy
+}
+
+func (p *policyPlugin) unwrap() Plugin {
+	return p.Plugin
+}
+
+// PoolExhaustedError is returned when a DispensePool plugin has no
+// implementation left to dispense.
+type PoolExhaustedError struct {
+	Name string
+	Size int
+}
+
+func init() {
+	RegisterErrorType("powerstrip.pool-exhausted", (*PoolExhaustedError)(nil))
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("plugin %s: all %d pooled implementations are in use", e.Name, e.Size)
+}
+
+// errNoArgs is returned by pluginServer for plugins that can't take
+// dispense arguments.
+var errNoArgs = errors.New("plugin doesn't take dispense arguments")
+
+// pluginServer creates a server implementation of p, passing args on if p
+// takes them.
+func pluginServer(p Plugin, b *MuxBroker, args interface{}) (interface{}, error) {
+	if sp, ok := lookupPlugin[ServerWithArgs](p); ok {
+		return sp.ServerWithArgs(b, args)
+	}
+	if args != nil {
+		return nil, errNoArgs
+	}
+	return p.Server(b)
+}
+
+// servedImpl is a server implementation of a plugin, with the limiter of
+// its calls, which the streams serving it share.
+type servedImpl struct {
+	impl    interface{}
+	limiter *callLimiter
+}
+
+// newServedImpl creates a server implementation of p, as pluginServer
+// does, with a limiter of its own.
+func newServedImpl(p Plugin, b *MuxBroker, args interface{}) (*servedImpl, error) {
+	impl, err := pluginServer(p, b, args)
+	if err != nil {
+		return nil, err
+	}
+	return &servedImpl{impl: impl, limiter: pluginLimiter(p)}, nil
+}
+
+func (s *servedImpl) close(name string) {
+	closeImpl(name, s.impl)
+}
+
+// errShared is returned by acquire for arguments to a plugin whose
+// implementations are shared.
+var errShared = errors.New("plugin is shared and can't be dispensed with arguments")
+
+// errConnClosed is returned by acquire once the connection is gone.
+var errConnClosed = errors.New("connection closed")
+
+// sharedImpls holds the implementations of a plugin that are shared
+// between the dispenses of a connection. They are created with the broker
+// of that connection, so they don't outlive it: they are closed once it
+// is gone and they aren't served anymore.
+type sharedImpls struct {
+	name string
+	lock sync.Mutex
+
+	// impl is the DispenseSingleton implementation, once created, and refs
+	// the number of streams serving it.
+	impl *servedImpl
+	refs int
+
+	// free holds the DispensePool implementations that aren't in use, once
+	// the pool is created.
+	free chan *servedImpl
+
+	// closed is set once the connection is gone, and closeCh closed then
+	// too, to wake up the dispenses waiting for the pool.
+	closed  bool
+	closeCh chan struct{}
+}
+
+// acquire returns an implementation of the plugin name according to its
+// dispense policy, along with the function that gives it back once it is
+// no longer served.
+func (d *dispenseServer) acquire(
+	name string, p Plugin, args interface{}) (*servedImpl, func(), error) {
+	var policy DispensePolicy
+	if pp, ok := lookupPlugin[DispensePolicyPlugin](p); ok {
+		policy = pp.DispensePolicy()
+	}
+
+	if policy.Mode == DispenseNew {
+		impl, err := newServedImpl(p, d.broker, args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return impl, func() { impl.close(name) }, nil
+	}
+
+	if args != nil {
+		return nil, nil, errShared
+	}
+
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return nil, nil, errConnClosed
+	}
+	if d.shared == nil {
+		d.shared = make(map[string]*sharedImpls)
+	}
+	shared, ok := d.shared[name]
+	if !ok {
+		shared = &sharedImpls{name: name, closeCh: make(chan struct{})}
+		d.shared[name] = shared
+	}
+	d.lock.Unlock()
+
+	switch policy.Mode {
+	case DispenseSingleton:
+		return shared.singleton(p, d.broker)
+	case DispensePool:
+		return shared.pooled(p, d.broker, policy)
+	default:
+		return nil, nil, fmt.Errorf("plugin %s: unknown dispense mode %d", name, policy.Mode)
+	}
+}
+
+// closeShared closes the shared implementations of the connection, once
+// they aren't served anymore. Dispensing them fails from then on.
+func (d *dispenseServer) closeShared() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+	for _, shared := range d.shared {
+		shared.close()
+	}
+}
+
+func (s *sharedImpls) singleton(p Plugin, b *MuxBroker) (*servedImpl, func(), error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, nil, errConnClosed
+	}
+	if s.impl == nil {
+		impl, err := newServedImpl(p, b, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.impl = impl
+	}
+	s.refs++
+
+	impl := s.impl
+	return impl, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.refs--; s.refs == 0 && s.closed {
+			impl.close(s.name)
+		}
+	}, nil
+}
+
+func (s *sharedImpls) pooled(
+	p Plugin, b *MuxBroker, policy DispensePolicy) (*servedImpl, func(), error) {
+	if policy.PoolSize <= 0 {
+		return nil, nil, fmt.Errorf("plugin %s: pool size must be positive", s.name)
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, nil, errConnClosed
+	}
+	if s.free == nil {
+		free := make(chan *servedImpl, policy.PoolSize)
+		for i := 0; i < policy.PoolSize; i++ {
+			impl, err := newServedImpl(p, b, nil)
+			if err != nil {
+				// Don't leak the ones created so far. The next dispense
+				// starts over.
+				s.lock.Unlock()
+				close(free)
+				for impl := range free {
+					impl.close(s.name)
+				}
+				return nil, nil, err
+			}
+			free <- impl
+		}
+		s.free = free
+	}
+	free := s.free
+	s.lock.Unlock()
+
+	exhausted := &PoolExhaustedError{Name: s.name, Size: policy.PoolSize}
+
+	var impl *servedImpl
+	select {
+	case impl = <-free:
+	default:
+		if policy.PoolTimeout <= 0 {
+			return nil, nil, exhausted
+		}
+
+		// Wait in line for an implementation to be released.
+		timer := time.NewTimer(policy.PoolTimeout)
+		defer timer.Stop()
+		select {
+		case impl = <-free:
+		case <-timer.C:
+			return nil, nil, exhausted
+		case <-s.closeCh:
+			return nil, nil, errConnClosed
+		}
+	}
+
+	// The pool may have been closed while we got the implementation.
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		impl.close(s.name)
+		return nil, nil, errConnClosed
+	}
+
+	return impl, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.closed {
+			impl.close(s.name)
+			return
+		}
+		free <- impl
+	}, nil
+}
+
+// close closes the implementations that aren't in use, and makes the ones
+// that are close once they are released.
+func (s *sharedImpls) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.closeCh)
+
+	if s.impl != nil && s.refs == 0 {
+		s.impl.close(s.name)
+	}
+	for done := s.free == nil; !done; {
+		select {
+		case impl := <-s.free:
+			impl.close(s.name)
+		default:
+			done = true
+		}
+	}
+}
+
+// closeImpl closes a dispensed implementation that is no longer served, if
+// it can be closed.
+func closeImpl(name string, impl interface{}) {
+	if c, ok := impl.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("[ERR] plugin: error closing %s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package powerstrip
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Dispense dispenses the plugin registered as name, and returns the
+// dispensed value as a T. A value that isn't a T is released, and an error
+// says what the plugin dispensed instead.
+func Dispense[T any](proto ClientProtocol, name string) (T, error) {
+	raw, err := proto.Dispense(name)
+	return dispensedAs[T](proto, name, raw, err)
+}
+
+// DispenseWithArgs is like Dispense, but passes args to the plugin, as
+// ClientProtocol.DispenseWithArgs does.
+func DispenseWithArgs[T any](proto ClientProtocol, name string, args interface{}) (T, error) {
+	raw, err := proto.DispenseWithArgs(name, args)
+	return dispensedAs[T](proto, name, raw, err)
+}
+
+// DispenseType is like Dispense, for the plugin registered for T with
+// RegisterType.
+func DispenseType[T any](proto ClientProtocol) (T, error) {
+	return Dispense[T](proto, PluginName[T]())
+}
+
+// DispenseTypeWithArgs is like DispenseWithArgs, for the plugin registered
+// for T with RegisterType.
+func DispenseTypeWithArgs[T any](proto ClientProtocol, args interface{}) (T, error) {
+	return DispenseWithArgs[T](proto, PluginName[T](), args)
+}
+
+func dispensedAs[T any](proto ClientProtocol, name string, raw interface{}, err error) (T, error) {
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	v, ok := raw.(T)
+	if !ok {
+		proto.Release(raw)
+		return zero, fmt.Errorf("plugin %s dispensed %T, which isn't a %s", name, raw, typeName[T]())
+	}
+	return v, nil
+}
+
+// typeName returns the name of the type T, which may be an interface.
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
+
+// PluginName returns the name RegisterType adds a plugin for T as, which
+// is the import path of the package T is defined in and the name of T,
+// like "example.com/greeter.Greeter". A plugin in another language
+// dispenses its implementation of T under this name.
+func PluginName[T any]() string {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Name() == "" || typ.PkgPath() == "" {
+		return typ.String()
+	}
+	return typ.PkgPath() + "." + typ.Name()
+}
+
+// Register adds p to set as name, for dispensing values of type T. The
+// value p.Client returns is checked against T, so that Dispense fails with
+// a descriptive error rather than the caller's type assertion panicking.
+// It panics if name is already registered in set.
+func Register[T any](set PluginSet, name string, p Plugin) {
+	if _, ok := set[name]; ok {
+		panic(fmt.Sprintf("powerstrip: plugin %q registered twice", name))
+	}
+	set[name] = &typedPlugin[T]{Plugin: p, name: name}
+}
+
+// RegisterType is like Register, but adds p under the name PluginName
+// returns for T, so that the host and the plugin only need to agree on T.
+func RegisterType[T any](set PluginSet, p Plugin) {
+	Register[T](set, PluginName[T](), p)
+}
+
+// typedPlugin checks the values a plugin's Client returns against T.
+type typedPlugin[T any] struct {
+	Plugin
+	name string
+}
+
+func (p *typedPlugin[T]) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	raw, err := p.Plugin.Client(b, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := raw.(T); !ok {
+		return nil, fmt.Errorf("plugin %s: client %T doesn't implement %s", p.name, raw, typeName[T]())
+	}
+	return raw, nil
+}
+
+func (p *typedPlugin[T]) unwrap() Plugin {
+	return p.Plugin
+}
@@ -0,0 +1,158 @@
+package powerstrip
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDispense(t *testing.T) {
+	client, _ := testRPCConn(t, testPluginMap)
+	defer client.Close()
+
+	impl, err := Dispense[testInterface](client, "test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := impl.Double(21); v != 42 {
+		t.Fatalf("bad: %d", v)
+	}
+	if err := client.Release(impl); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err = Dispense[io.Reader](client, "test")
+	if err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(err.Error(), "io.Reader") {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The value of the wrong type was released.
+	if n := client.NumInstances(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	if _, err := Dispense[testInterface](client, "nope"); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	set := PluginSet{}
+	Register[testInterface](set, "test", new(testInterfacePlugin))
+	Register[io.Reader](set, "reader", new(testInterfacePlugin))
+	Register[Caller](set, "args", new(testArgsPlugin))
+
+	client, _ := testRPCConn(t, set)
+	defer client.Close()
+
+	if _, err := Dispense[testInterface](client, "test"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err := client.Dispense("reader")
+	if err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(err.Error(), "doesn't implement io.Reader") {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Dispense arguments still reach the plugin.
+	if _, err := DispenseWithArgs[Caller](client, "args", 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestRegister_twice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("should panic")
+		}
+	}()
+
+	set := PluginSet{}
+	Register[testInterface](set, "test", new(testInterfacePlugin))
+	Register[testInterface](set, "test", new(testInterfacePlugin))
+}
+
+func TestRegisterType(t *testing.T) {
+	set := PluginSet{}
+	RegisterType[testInterface](set, new(testInterfacePlugin))
+	RegisterType[Caller](set, new(testArgsPlugin))
+	if _, ok := set["github.com/zeroFruit/powerstrip.testInterface"]; !ok {
+		t.Fatalf("bad: %#v", set)
+	}
+
+	client, _ := testRPCConn(t, set)
+	defer client.Close()
+
+	impl, err := DispenseType[testInterface](client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := impl.Double(21); v != 42 {
+		t.Fatalf("bad: %d", v)
+	}
+	if _, err := DispenseTypeWithArgs[Caller](client, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A type that isn't registered isn't found.
+	if _, err := DispenseType[io.Reader](client); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+// The optional plugin interfaces are found through any nesting of
+// wrappers.
+func TestRegister_wrapped(t *testing.T) {
+	set := PluginSet{}
+	Register[testInterface](set, "test", WithCallLimits(
+		WithDispensePolicy(new(testInterfacePlugin), DispensePolicy{Mode: DispenseSingleton}),
+		CallLimits{Serial: true}))
+	Register[Caller](set, "args", WithDispensePolicy(
+		WithCallLimits(new(testArgsPlugin), CallLimits{Serial: true}),
+		DispensePolicy{}))
+
+	p := set["test"]
+	if _, ok := lookupPlugin[CapabilityPlugin](p); !ok {
+		t.Fatal("no capabilities")
+	}
+	if pp, ok := lookupPlugin[DispensePolicyPlugin](p); !ok || pp.DispensePolicy().Mode != DispenseSingleton {
+		t.Fatal("no dispense policy")
+	}
+	if lp, ok := lookupPlugin[CallLimitsPlugin](p); !ok || !lp.CallLimits().Serial {
+		t.Fatal("no call limits")
+	}
+	if _, ok := lookupPlugin[ServerWithArgs](set["args"]); !ok {
+		t.Fatal("no ServerWithArgs")
+	}
+
+	client, _ := testRPCConn(t, set)
+	defer client.Close()
+
+	plugins, err := client.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, desc := range plugins {
+		if desc.Name == "test" && desc.Capabilities == nil {
+			t.Fatalf("bad: %#v", desc)
+		}
+	}
+
+	c, err := DispenseWithArgs[Caller](client, "args", 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp string
+	if err := c.Call("Plugin.Args", true, &resp); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp != "2" {
+		t.Fatalf("bad: %s", resp)
+	}
+}
@@ -0,0 +1,270 @@
+package powerstrip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// errorPrefix marks the response errors that carry a registered error. The
+// JSON form of a wireError follows it.
+const errorPrefix = "powerstrip-error:"
+
+// errorRegistry maps the registered errors to their codes and back.
+var errorRegistry = struct {
+	sync.RWMutex
+
+	sentinels     map[string]error
+	sentinelCodes map[error]string
+	types         map[string]reflect.Type
+	typeCodes     map[reflect.Type]string
+}{
+	sentinels:     make(map[string]error),
+	sentinelCodes: make(map[error]string),
+	types:         make(map[string]reflect.Type),
+	typeCodes:     make(map[reflect.Type]string),
+}
+
+func init() {
+	RegisterErrorType("powerstrip.panic", (*RemotePanicError)(nil))
+
+	// A method that gives up with its context, which ends when the host
+	// gives up or the deadline of the call passes, fails with these. The
+	// host tells them apart from other errors, to retry calls that timed
+	// out.
+	RegisterError("powerstrip.canceled", context.Canceled)
+	RegisterError("powerstrip.deadline-exceeded", context.DeadlineExceeded)
+}
+
+// RegisterError registers a sentinel error under code, so that errors.Is
+// matches it on the host when the plugin returns it, or an error wrapping
+// it. Both sides must register it, usually from the init function of a
+// package they share. It panics if code or err is already registered.
+func RegisterError(code string, err error) {
+	if err == nil || !reflect.TypeOf(err).Comparable() {
+		panic(fmt.Sprintf("powerstrip: sentinel error %q must be comparable", code))
+	}
+
+	errorRegistry.Lock()
+	defer errorRegistry.Unlock()
+	checkErrorCode(code)
+	if _, ok := errorRegistry.sentinelCodes[err]; ok {
+		panic(fmt.Sprintf("powerstrip: error %q registered twice", err))
+	}
+	errorRegistry.sentinels[code] = err
+	errorRegistry.sentinelCodes[err] = code
+}
+
+// RegisterErrorType registers the type of err under code, so that
+// errors.As finds it on the host when the plugin returns an error of that
+// type. The fields of the error travel as JSON. Both sides must register
+// it. It panics if code or the type is already registered.
+func RegisterErrorType(code string, err error) {
+	if err == nil {
+		panic(fmt.Sprintf("powerstrip: error type %q is nil", code))
+	}
+	typ := reflect.TypeOf(err)
+
+	errorRegistry.Lock()
+	defer errorRegistry.Unlock()
+	checkErrorCode(code)
+	if _, ok := errorRegistry.typeCodes[typ]; ok {
+		panic(fmt.Sprintf("powerstrip: error type %s registered twice", typ))
+	}
+	errorRegistry.types[code] = typ
+	errorRegistry.typeCodes[typ] = code
+}
+
+// checkErrorCode panics if code can't be registered. The registry must be
+// locked.
+func checkErrorCode(code string) {
+	if code == "" {
+		panic("powerstrip: empty error code")
+	}
+	_, sentinel := errorRegistry.sentinels[code]
+	_, typed := errorRegistry.types[code]
+	if sentinel || typed {
+		panic(fmt.Sprintf("powerstrip: error code %q registered twice", code))
+	}
+}
+
+// wireError is the form an error travels in.
+type wireError struct {
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Cause   *wireError      `json:"cause,omitempty"`
+}
+
+// encodeError returns the response error string for err. Errors with no
+// registered error in their chain are sent as plain strings, as net/rpc
+// does.
+func encodeError(err error) string {
+	w, registered := newWireError(err)
+	if !registered {
+		return err.Error()
+	}
+	data, jerr := json.Marshal(w)
+	if jerr != nil {
+		return err.Error()
+	}
+	return errorPrefix + string(data)
+}
+
+// newWireError returns the wire form of err and its chain, and whether any
+// error in the chain is registered.
+func newWireError(err error) (*wireError, bool) {
+	w := &wireError{Message: err.Error()}
+
+	// An error from the other side keeps its code when it is passed on,
+	// as it is when a callback's error is returned.
+	if re, ok := err.(*RemoteError); ok {
+		w.Code = re.Code
+		w.Details = re.Details
+		registered := w.Code != ""
+		if re.cause != nil {
+			var causeRegistered bool
+			w.Cause, causeRegistered = newWireError(re.cause)
+			registered = registered || causeRegistered
+		}
+		return w, registered
+	}
+
+	errorRegistry.RLock()
+	typ := reflect.TypeOf(err)
+	if code, ok := errorRegistry.typeCodes[typ]; ok {
+		w.Code = code
+		if details, jerr := json.Marshal(err); jerr == nil {
+			w.Details = details
+		}
+	} else if typ.Comparable() {
+		w.Code = errorRegistry.sentinelCodes[err]
+	}
+	errorRegistry.RUnlock()
+
+	registered := w.Code != ""
+	if cause := errors.Unwrap(err); cause != nil {
+		var causeRegistered bool
+		w.Cause, causeRegistered = newWireError(cause)
+		registered = registered || causeRegistered
+	}
+	return w, registered
+}
+
+// decode turns w back into an error.
+func (w *wireError) decode() error {
+	e := &RemoteError{
+		Code:    w.Code,
+		Message: w.Message,
+		Details: w.Details,
+	}
+	if w.Cause != nil {
+		e.cause = w.Cause.decode()
+	}
+
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	if sentinel, ok := errorRegistry.sentinels[w.Code]; ok {
+		e.err = sentinel
+	} else if typ, ok := errorRegistry.types[w.Code]; ok {
+		e.err = decodeErrorType(typ, w.Details)
+	}
+	return e
+}
+
+// decodeErrorType returns a new error of type typ holding details, or nil
+// if details can't be decoded into it.
+func decodeErrorType(typ reflect.Type, details json.RawMessage) error {
+	var v reflect.Value
+	if typ.Kind() == reflect.Ptr {
+		v = reflect.New(typ.Elem())
+	} else {
+		v = reflect.New(typ)
+	}
+	if len(details) > 0 {
+		if err := json.Unmarshal(details, v.Interface()); err != nil {
+			return nil
+		}
+	}
+	if typ.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	err, _ := v.Interface().(error)
+	return err
+}
+
+// RemoteError is an error returned by the other side of a connection that
+// has a registered error in its chain. errors.Is and errors.As see the
+// registered errors it was decoded from.
+type RemoteError struct {
+	// Code is the code the error was registered under, or empty if only
+	// errors it wraps are registered.
+	Code string
+
+	// Message is the message of the original error.
+	Message string
+
+	// Details holds the JSON encoded fields of a registered error type.
+	Details json.RawMessage
+
+	// err is the registered error, if it is registered on this side too.
+	err error
+
+	// cause is the error the original error wrapped.
+	cause error
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error the original error wrapped, if any.
+func (e *RemoteError) Unwrap() error {
+	return e.cause
+}
+
+func (e *RemoteError) Is(target error) bool {
+	return e.err != nil && errors.Is(e.err, target)
+}
+
+func (e *RemoteError) As(target interface{}) bool {
+	return e.err != nil && errors.As(e.err, target)
+}
+
+// RemotePanicError is returned for a call that panicked on the other side.
+type RemotePanicError struct {
+	// Method is the service method of the call.
+	Method string
+
+	// Value is the value passed to panic.
+	Value string
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack string
+}
+
+func (e *RemotePanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %s", e.Method, e.Value)
+}
+
+// DecodeError turns an error returned by a *rpc.Client call back into the
+// error the other side returned, as far as its errors are registered. Other
+// errors are returned as they are. The ClientProtocol methods and Callers
+// already decode their errors.
+func DecodeError(err error) error {
+	se, ok := err.(rpc.ServerError)
+	if !ok || !strings.HasPrefix(string(se), errorPrefix) {
+		return err
+	}
+
+	var w wireError
+	if jerr := json.Unmarshal([]byte(se[len(errorPrefix):]), &w); jerr != nil {
+		return err
+	}
+	return w.decode()
+}
@@ -0,0 +1,150 @@
+package powerstrip
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+var testErrSentinel = errors.New("sentinel")
+
+type testTypedError struct {
+	Field string
+	Err   error `json:"-"`
+}
+
+func (e *testTypedError) Error() string { return "typed: " + e.Field }
+
+func (e *testTypedError) Unwrap() error { return e.Err }
+
+func init() {
+	RegisterError("powerstrip.test-sentinel", testErrSentinel)
+	RegisterErrorType("powerstrip.test-typed", (*testTypedError)(nil))
+}
+
+func TestDecodeError(t *testing.T) {
+	cases := []struct {
+		Name string
+		Err  error
+	}{
+		{"sentinel", testErrSentinel},
+		{"wrapped", fmt.Errorf("wrapping: %w", testErrSentinel)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := DecodeError(rpc.ServerError(encodeError(tc.Err)))
+			if err.Error() != tc.Err.Error() {
+				t.Fatalf("bad: %s", err)
+			}
+			if !errors.Is(err, testErrSentinel) {
+				t.Fatalf("bad: %#v", err)
+			}
+		})
+	}
+
+	// Unregistered errors stay plain strings.
+	if msg := encodeError(errors.New("plain")); msg != "plain" {
+		t.Fatalf("bad: %s", msg)
+	}
+
+	// Other errors are left alone.
+	if err := DecodeError(rpc.ErrShutdown); err != rpc.ErrShutdown {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestDecodeError_relayed(t *testing.T) {
+	orig := fmt.Errorf("wrapping: %w", &testTypedError{Field: "foo"})
+
+	// An error decoded on one side and returned again keeps its code.
+	err := DecodeError(rpc.ServerError(encodeError(orig)))
+	err = DecodeError(rpc.ServerError(encodeError(err)))
+	if err.Error() != orig.Error() {
+		t.Fatalf("bad: %s", err)
+	}
+	var typed *testTypedError
+	if !errors.As(err, &typed) || typed.Field != "foo" {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestRegisterError_twice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("should panic")
+		}
+	}()
+	RegisterError("powerstrip.test-sentinel", errors.New("other"))
+}
+
+func TestRPCClient_errors(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"error": new(testErrorPlugin),
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("error")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	fail := func(kind string) error {
+		return DecodeError(c.Call("Plugin.Fail", kind, new(struct{})))
+	}
+
+	err = fail("sentinel")
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %#v", err)
+	}
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != "powerstrip.test-sentinel" {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	err = fail("wrapped")
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %#v", err)
+	}
+	if err.Error() != "wrapping: sentinel" {
+		t.Fatalf("bad: %s", err)
+	}
+
+	err = fail("typed")
+	var typed *testTypedError
+	if !errors.As(err, &typed) || typed.Field != "value" {
+		t.Fatalf("bad: %#v", err)
+	}
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("cause lost: %#v", err)
+	}
+
+	err = fail("plain")
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "plain" {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestRPCClient_poolExhaustedError(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"count": WithDispensePolicy(new(testCountPlugin), DispensePolicy{
+			Mode:     DispensePool,
+			PoolSize: 1,
+		}),
+	})
+	defer client.Close()
+
+	if _, err := client.Dispense("count"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err := client.Dispense("count")
+	var exhausted *PoolExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("bad: %#v", err)
+	}
+	if exhausted.Name != "count" || exhausted.Size != 1 {
+		t.Fatalf("bad: %#v", exhausted)
+	}
+}
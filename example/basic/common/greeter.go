@@ -0,0 +1,22 @@
+package common
+
+import (
+	"errors"
+
+	"github.com/zeroFruit/powerstrip"
+)
+
+//go:generate go run github.com/zeroFruit/powerstrip/cmd/powerstrip-gen -type Greeter
+
+// ErrNoName is returned by GreetName when it is given an empty name.
+var ErrNoName = errors.New("no name to greet")
+
+func init() {
+	// Registered on both sides, so the host can match it with errors.Is.
+	powerstrip.RegisterError("greeter.no-name", ErrNoName)
+}
+
+type Greeter interface {
+	Greet() string
+	GreetName(name string) (string, error)
+}
@@ -0,0 +1,78 @@
+// Code generated by powerstrip-gen. DO NOT EDIT.
+
+package common
+
+import (
+	"github.com/zeroFruit/powerstrip"
+)
+
+// GreeterGreetArgs are the arguments of Greeter.Greet.
+type GreeterGreetArgs struct{}
+
+// GreeterGreetReply is the reply of Greeter.Greet.
+type GreeterGreetReply struct {
+	Result0 string
+}
+
+// GreeterGreetNameArgs are the arguments of Greeter.GreetName.
+type GreeterGreetNameArgs struct {
+	Name string
+}
+
+// GreeterGreetNameReply is the reply of Greeter.GreetName.
+type GreeterGreetNameReply struct {
+	Result0 string
+}
+
+// GreeterRPC is the client of Greeter. It implements Greeter by calling the
+// other side.
+type GreeterRPC struct {
+	client powerstrip.Caller
+	broker *powerstrip.MuxBroker
+}
+
+func (c *GreeterRPC) Greet() string {
+	var reply GreeterGreetReply
+	err := c.client.Call("Plugin.Greet", &GreeterGreetArgs{}, &reply)
+	if err != nil {
+		panic(err)
+	}
+	return reply.Result0
+}
+
+func (c *GreeterRPC) GreetName(name string) (string, error) {
+	var reply GreeterGreetNameReply
+	err := c.client.Call("Plugin.GreetName", &GreeterGreetNameArgs{Name: name}, &reply)
+	return reply.Result0, err
+}
+
+// GreeterRPCServer serves Impl to a GreeterRPC.
+type GreeterRPCServer struct {
+	Impl   Greeter
+	broker *powerstrip.MuxBroker
+}
+
+func (s *GreeterRPCServer) Greet(args *GreeterGreetArgs, reply *GreeterGreetReply) error {
+	reply.Result0 = s.Impl.Greet()
+	return nil
+}
+
+func (s *GreeterRPCServer) GreetName(args *GreeterGreetNameArgs, reply *GreeterGreetNameReply) error {
+	var err error
+	reply.Result0, err = s.Impl.GreetName(args.Name)
+	return err
+}
+
+// GreeterPlugin is the powerstrip.Plugin of Greeter. The plugin sets Impl, the
+// host leaves it empty.
+type GreeterPlugin struct {
+	Impl Greeter
+}
+
+func (p *GreeterPlugin) Server(b *powerstrip.MuxBroker) (interface{}, error) {
+	return &GreeterRPCServer{Impl: p.Impl, broker: b}, nil
+}
+
+func (GreeterPlugin) Client(b *powerstrip.MuxBroker, c powerstrip.Caller) (interface{}, error) {
+	return &GreeterRPC{client: c, broker: b}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os/exec"
@@ -9,11 +10,10 @@ import (
 	"github.com/zeroFruit/powerstrip/example/basic/common"
 )
 
-var pluginMap = map[string]powerstrip.Plugin{
-	"greeter": &common.GreeterPlugin{},
-}
-
 func main() {
+	pluginMap := powerstrip.PluginSet{}
+	powerstrip.Register[common.Greeter](pluginMap, "greeter", &common.GreeterPlugin{})
+
 	client := powerstrip.NewClient(&powerstrip.ClientConfig{
 		Plugins: pluginMap,
 		Cmd:     exec.Command("./plugin/greeter"),
@@ -25,11 +25,13 @@ func main() {
 		log.Fatal(err)
 	}
 
-	raw, err := rpcClient.Dispense("greeter")
+	greeter, err := powerstrip.Dispense[common.Greeter](rpcClient, "greeter")
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	greeter := raw.(common.Greeter)
 	fmt.Println(greeter.Greet())
+
+	if _, err := greeter.GreetName(""); errors.Is(err, common.ErrNoName) {
+		fmt.Println("The plugin wants a name:", err)
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/zeroFruit/powerstrip"
 	"github.com/zeroFruit/powerstrip/example/basic/common"
 )
@@ -11,6 +13,13 @@ func (g *GreeterHello) Greet() string {
 	return "Hello!"
 }
 
+func (g *GreeterHello) GreetName(name string) (string, error) {
+	if name == "" {
+		return "", common.ErrNoName
+	}
+	return fmt.Sprintf("Hello %s!", name), nil
+}
+
 func main() {
 	greeter := &GreeterHello{}
 
@@ -19,5 +28,9 @@ func main() {
 	}
 	powerstrip.Serve(&powerstrip.ServeConfig{
 		Plugins: pluginMap,
+		Info: powerstrip.PluginInfo{
+			Name:    "greeter",
+			Version: "0.1.0",
+		},
 	})
 }
@@ -0,0 +1,330 @@
+package powerstrip
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+// File descriptors travel on a side channel: a second connection to the
+// plugin's unix socket, next to the one the mux runs on. It is only opened
+// once a descriptor is passed. The host asks for it with the
+// Control.FDChannel call, which returns a token, then dials the socket
+// again and opens the connection with fdChannelMagic and the token, so
+// that the plugin knows which connection it belongs to. The plugin acks it
+// with a single byte once the channel is ready. A plugin that needs the
+// channel first asks the host to open it by dialing fdChannelID; the host
+// closes that stream once the channel is open, after writing why if it
+// couldn't be.
+//
+// Each message on the channel is a little endian uint32 ID, with the
+// descriptor attached to it as SCM_RIGHTS. The ID is picked with NextId
+// and handed to the other side in a call, like a stream ID.
+const fdChannelMagic = "PSFD"
+
+// fdTimeout is how long a descriptor waits to be received, and how long
+// ReceiveFile waits for it.
+const fdTimeout = 5 * time.Second
+
+// fdChannelID is the broker ID the host serves requests to open the file
+// descriptor channel on. MuxBroker.NextId never gets this far, and the
+// host services come after it.
+const fdChannelID = hostServiceBaseID - 1
+
+// fdTokenTimeout is how long a token handed out by Control.FDChannel can
+// be used to open the channel.
+var fdTokenTimeout = 5 * time.Second
+
+// errNoFDChannel is returned when no channel was set up, because the
+// connection isn't a unix socket or the other side doesn't support it.
+var errNoFDChannel = errors.New("file descriptors can only be passed over a unix socket connection")
+
+// SendFile sends a duplicate of the descriptor of f to the other side, and
+// returns the ID to pass on to it for ReceiveFile. f stays open, and can
+// be closed once SendFile returns.
+//
+// Descriptors can only be sent when the plugin is connected over a unix
+// socket; over TCP, or to a sandboxed plugin, this returns an error.
+func (m *MuxBroker) SendFile(f *os.File) (uint32, error) {
+	ch, err := m.fdChannel()
+	if err != nil {
+		return 0, err
+	}
+	id := m.NextId()
+	if err := ch.send(id, f); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// ReceiveFile returns the file the other side sent with SendFile as id.
+// It waits up to 5 seconds for it. A file that isn't received in that
+// time is closed.
+func (m *MuxBroker) ReceiveFile(id uint32) (*os.File, error) {
+	ch, err := m.fdChannel()
+	if err != nil {
+		return nil, err
+	}
+	return ch.receive(id)
+}
+
+// SendConn sends conn to the other side, like SendFile, for ReceiveConn.
+// conn must have a descriptor, like the connections of the net package,
+// and stays usable.
+func (m *MuxBroker) SendConn(conn net.Conn) (uint32, error) {
+	fc, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("can't send a %T: it has no file descriptor", conn)
+	}
+	f, err := fc.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return m.SendFile(f)
+}
+
+// ReceiveConn returns the connection the other side sent with SendConn as
+// id.
+func (m *MuxBroker) ReceiveConn(id uint32) (net.Conn, error) {
+	f, err := m.ReceiveFile(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// fdChannel returns the file descriptor channel, opening it first if it
+// isn't open yet.
+func (m *MuxBroker) fdChannel() (*fdChannel, error) {
+	m.fdOpenLock.Lock()
+	defer m.fdOpenLock.Unlock()
+
+	m.Lock()
+	fds, fdErr, open := m.fds, m.fdErr, m.fdOpen
+	m.Unlock()
+	switch {
+	case fds != nil:
+		return fds, nil
+	case fdErr != nil:
+		return nil, fdErr
+	case open == nil:
+		return nil, errNoFDChannel
+	}
+
+	if err := open(); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.fds == nil {
+		return nil, errNoFDChannel
+	}
+	return m.fds, nil
+}
+
+func (m *MuxBroker) setFDChannel(ch *fdChannel, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.fds, m.fdErr = ch, err
+}
+
+// fdTransportErr returns an error if descriptors can't be passed over
+// conn because it isn't a unix socket.
+func fdTransportErr(conn io.ReadWriteCloser) error {
+	c, ok := conn.(net.Conn)
+	if !ok || c.LocalAddr() == nil {
+		return nil
+	}
+	if network := c.LocalAddr().Network(); network != "unix" {
+		return fmt.Errorf("file descriptors can only be passed over a unix socket, not %s", network)
+	}
+	return nil
+}
+
+// prepareFDChannel sets up the broker to open the side channel to the
+// plugin conn connects to once it is needed, by either side.
+func (c *RPCClient) prepareFDChannel(conn io.ReadWriteCloser) {
+	addr, err := fdChannelAddr(conn)
+	m := c.broker
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		m.fdErr = err
+	} else {
+		m.fdOpen = func() error { return c.openFDChannel(addr) }
+	}
+
+	if m.handlers == nil {
+		m.handlers = make(map[uint32]func(net.Conn))
+	}
+	m.handlers[fdChannelID] = func(conn net.Conn) {
+		defer conn.Close()
+		if err := binary.Write(conn, binary.LittleEndian, fdChannelID); err != nil {
+			return
+		}
+		if _, err := m.fdChannel(); err != nil {
+			conn.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// fdChannelAddr returns the address of the unix socket conn connects to,
+// to open the side channel to.
+func fdChannelAddr(conn io.ReadWriteCloser) (*net.UnixAddr, error) {
+	if err := fdTransportErr(conn); err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errNoFDChannel
+	}
+	addr, _ := uc.RemoteAddr().(*net.UnixAddr)
+	if addr == nil || addr.Name == "" {
+		// A socketpair, which can't be dialed again.
+		return nil, errors.New("file descriptors can only be passed to a plugin listening on a unix socket")
+	}
+	return addr, nil
+}
+
+// openFDChannel opens the side channel to the plugin listening on addr.
+func (c *RPCClient) openFDChannel(addr *net.UnixAddr) error {
+	var token uint64
+	if err := c.call("Control.FDChannel", true, &token); err != nil {
+		return fmt.Errorf("opening the file descriptor channel: %s", err)
+	}
+
+	side, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return err
+	}
+	side.SetDeadline(time.Now().Add(fdTimeout))
+	hello := make([]byte, len(fdChannelMagic)+8)
+	copy(hello, fdChannelMagic)
+	binary.LittleEndian.PutUint64(hello[len(fdChannelMagic):], token)
+	if _, err := side.Write(hello); err != nil {
+		side.Close()
+		return err
+	}
+	if _, err := io.ReadFull(side, make([]byte, 1)); err != nil {
+		side.Close()
+		return fmt.Errorf("opening the file descriptor channel: %s", err)
+	}
+	side.SetDeadline(time.Time{})
+
+	ch, err := newFDChannel(side)
+	if err != nil {
+		side.Close()
+		return err
+	}
+	c.broker.setFDChannel(ch, nil)
+	return nil
+}
+
+// requestFDChannel asks the host to open the file descriptor channel.
+func (m *MuxBroker) requestFDChannel() error {
+	conn, err := m.Dial(fdChannelID)
+	if err != nil {
+		return fmt.Errorf("opening the file descriptor channel: %s", err)
+	}
+	defer conn.Close()
+
+	msg, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("opening the file descriptor channel: %s", err)
+	}
+	if len(msg) > 0 {
+		return errors.New(string(msg))
+	}
+	return nil
+}
+
+// FDChannel registers a token for the host to open the file descriptor
+// channel of this connection with. A token that isn't used in time
+// expires.
+func (c *controlServer) FDChannel(
+	null bool, response *uint64) error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	token := binary.LittleEndian.Uint64(b[:])
+
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if c.server.fdTokens == nil {
+		c.server.fdTokens = make(map[uint64]*MuxBroker)
+	}
+	c.server.fdTokens[token] = c.broker
+	time.AfterFunc(fdTokenTimeout, func() {
+		c.server.lock.Lock()
+		defer c.server.lock.Unlock()
+		delete(c.server.fdTokens, token)
+	})
+	*response = token
+	return nil
+}
+
+// accept serves a connection accepted by Serve: either a mux connection or
+// the file descriptor channel of one.
+func (s *RPCServer) accept(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	magic, err := br.Peek(len(fdChannelMagic))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if string(magic) == fdChannelMagic {
+		s.serveFDChannel(conn, br)
+		return
+	}
+	s.ServeConn(&peekedConn{r: br, Conn: conn})
+}
+
+// serveFDChannel attaches the file descriptor channel conn opens to the
+// connection whose token it sends.
+func (s *RPCServer) serveFDChannel(conn net.Conn, br *bufio.Reader) {
+	hello := make([]byte, len(fdChannelMagic)+8)
+	if _, err := io.ReadFull(br, hello); err != nil || br.Buffered() > 0 {
+		conn.Close()
+		return
+	}
+	token := binary.LittleEndian.Uint64(hello[len(fdChannelMagic):])
+
+	s.lock.Lock()
+	broker, ok := s.fdTokens[token]
+	delete(s.fdTokens, token)
+	s.lock.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	ch, err := newFDChannel(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	broker.setFDChannel(ch, nil)
+	if _, err := conn.Write([]byte{1}); err != nil {
+		ch.close()
+	}
+}
+
+// peekedConn is a connection whose first bytes were peeked at.
+type peekedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,27 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package powerstrip
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// fdChannel is only supported on unix, since it relies on SCM_RIGHTS.
+type fdChannel struct{}
+
+func newFDChannel(conn net.Conn) (*fdChannel, error) {
+	return nil, errors.New("passing file descriptors is only supported on unix")
+}
+
+func (c *fdChannel) send(id uint32, f *os.File) error {
+	return errNoFDChannel
+}
+
+func (c *fdChannel) receive(id uint32) (*os.File, error) {
+	return nil, errNoFDChannel
+}
+
+func (c *fdChannel) close() error { return nil }
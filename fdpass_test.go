@@ -0,0 +1,277 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package powerstrip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRPCServeListener serves server on a listener of network, and
+// connects to it.
+func testRPCServeListener(t *testing.T, server *RPCServer, network string) *RPCClient {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "plugin.sock")
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go server.Serve(lis)
+
+	conn, err := net.Dial(network, lis.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	client, err := NewRPCClient(conn, server.Plugins)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return client
+}
+
+func testFDDispense(t *testing.T, network string) *testFDClient {
+	server := &RPCServer{
+		Plugins: map[string]Plugin{"fd": new(testFDPlugin)},
+		Stdout:  new(bytes.Buffer),
+		Stderr:  new(bytes.Buffer),
+	}
+	client := testRPCServeListener(t, server, network)
+	t.Cleanup(func() { client.Close() })
+
+	raw, err := client.Dispense("fd")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return raw.(*testFDClient)
+}
+
+func TestMuxBroker_sendFile(t *testing.T) {
+	c := testFDDispense(t, "unix")
+
+	path := filepath.Join(t.TempDir(), "foo")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	id, err := c.broker.SendFile(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The file stays usable here.
+	f.Close()
+
+	var reply string
+	if err := c.client.Call("Plugin.ReadFile", id, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reply != "hello" {
+		t.Fatalf("bad: %q", reply)
+	}
+
+	// And back the other way.
+	if err := c.client.Call("Plugin.OpenFile", path, &id); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err = c.broker.ReceiveFile(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestMuxBroker_sendConn(t *testing.T) {
+	c := testFDDispense(t, "unix")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer lis.Close()
+	local, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer local.Close()
+	remote, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	id, err := c.broker.SendConn(remote)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	remote.Close()
+
+	if err := c.client.Call("Plugin.WriteConn", id, &struct{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The plugin closed the last copy of the connection.
+	data, err := ioutil.ReadAll(local)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestClient_sendFile(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("test-fd"),
+		Plugins: map[string]Plugin{"fd": new(testFDPlugin)},
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("fd")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fd := raw.(*testFDClient)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	id, err := fd.broker.SendFile(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	r.Close()
+	w.Write([]byte("hello"))
+	w.Close()
+
+	var reply string
+	if err := fd.client.Call("Plugin.ReadFile", id, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reply != "hello" {
+		t.Fatalf("bad: %q", reply)
+	}
+}
+
+func TestMuxBroker_receiveFileTimeout(t *testing.T) {
+	c := testFDDispense(t, "unix")
+
+	var reply string
+	err := c.client.Call("Plugin.ReadFile", uint32(1234), &reply)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_sendFileTCP(t *testing.T) {
+	c := testFDDispense(t, "tcp")
+
+	_, err := c.broker.SendFile(os.Stdin)
+	if err == nil || !strings.Contains(err.Error(), "not tcp") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The plugin side refuses too.
+	var id uint32
+	err = c.client.Call("Plugin.OpenFile", os.DevNull, &id)
+	if err == nil || !strings.Contains(err.Error(), "not tcp") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_sendFilePluginFirst(t *testing.T) {
+	server := &RPCServer{
+		Plugins: map[string]Plugin{"fd": new(testFDPlugin)},
+		Stdout:  new(bytes.Buffer),
+		Stderr:  new(bytes.Buffer),
+	}
+	client := testRPCServeListener(t, server, "unix")
+	defer client.Close()
+
+	// The channel isn't opened until a descriptor is passed.
+	client.broker.Lock()
+	fds := client.broker.fds
+	client.broker.Unlock()
+	if fds != nil {
+		t.Fatal("channel opened up front")
+	}
+
+	raw, err := client.Dispense("fd")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(*testFDClient)
+
+	// The plugin has the host open it.
+	path := filepath.Join(t.TempDir(), "foo")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var id uint32
+	if err := c.client.Call("Plugin.OpenFile", path, &id); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err := c.broker.ReceiveFile(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestRPCServer_fdTokenTimeout(t *testing.T) {
+	old := fdTokenTimeout
+	fdTokenTimeout = 10 * time.Millisecond
+	defer func() { fdTokenTimeout = old }()
+
+	server := &RPCServer{
+		Plugins: map[string]Plugin{},
+		Stdout:  new(bytes.Buffer),
+		Stderr:  new(bytes.Buffer),
+	}
+	client := testRPCServeListener(t, server, "unix")
+	defer client.Close()
+
+	var token uint64
+	if err := client.call("Control.FDChannel", true, &token); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The token expires if nobody opens the channel with it.
+	time.Sleep(100 * time.Millisecond)
+	server.lock.Lock()
+	n := len(server.fdTokens)
+	server.lock.Unlock()
+	if n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
@@ -0,0 +1,196 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package powerstrip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fdChannel sends and receives descriptors as SCM_RIGHTS over a unix
+// socket.
+type fdChannel struct {
+	conn *net.UnixConn
+
+	// writeLock keeps a message and its descriptor together.
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint32]chan *os.File
+	closed  bool
+}
+
+func newFDChannel(conn net.Conn) (*fdChannel, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errNoFDChannel
+	}
+	c := &fdChannel{
+		conn:    uc,
+		pending: make(map[uint32]chan *os.File),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *fdChannel) send(id uint32, f *os.File) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var msg [4]byte
+	binary.LittleEndian.PutUint32(msg[:], id)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	var werr error
+	err = raw.Control(func(fd uintptr) {
+		_, _, werr = c.conn.WriteMsgUnix(msg[:], syscall.UnixRights(int(fd)), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+func (c *fdChannel) receive(id uint32) (*os.File, error) {
+	ch := c.getPending(id)
+	select {
+	case f := <-ch:
+		c.deletePending(id, ch)
+		return f, nil
+	case <-time.After(fdTimeout):
+		c.deletePending(id, ch)
+		return nil, fmt.Errorf("timeout waiting for file descriptor %d", id)
+	}
+}
+
+// run receives the descriptors the other side sends, until the channel is
+// closed.
+func (c *fdChannel) run() {
+	defer c.close()
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		var msg [4]byte
+		n, oobn, flags, _, err := c.conn.ReadMsgUnix(msg[:], oob)
+		if err != nil {
+			return
+		}
+		fds, err := parseRights(oob[:oobn])
+		if err != nil || flags&syscall.MSG_CTRUNC != 0 {
+			log.Printf("[ERR] plugin: bad file descriptor message: %v", err)
+			closeFDs(fds)
+			return
+		}
+		if n < len(msg) {
+			if _, err := io.ReadFull(c.conn, msg[n:]); err != nil {
+				closeFDs(fds)
+				return
+			}
+		}
+		if len(fds) != 1 {
+			log.Printf("[ERR] plugin: expected 1 file descriptor, got %d", len(fds))
+			closeFDs(fds)
+			continue
+		}
+
+		syscall.CloseOnExec(fds[0])
+		id := binary.LittleEndian.Uint32(msg[:])
+		c.deliver(id, os.NewFile(uintptr(fds[0]), fmt.Sprintf("fd-%d", id)))
+	}
+}
+
+// deliver hands f to the receiver of id, or closes it if it isn't
+// received in time.
+func (c *fdChannel) deliver(id uint32, f *os.File) {
+	ch := c.getPending(id)
+	select {
+	case ch <- f:
+	default:
+		// The ID was already used.
+		f.Close()
+		return
+	}
+
+	time.AfterFunc(fdTimeout, func() {
+		c.deletePending(id, ch)
+		select {
+		case f := <-ch:
+			f.Close()
+		default:
+		}
+	})
+}
+
+func (c *fdChannel) getPending(id uint32) chan *os.File {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch, ok := c.pending[id]
+	if !ok {
+		ch = make(chan *os.File, 1)
+		c.pending[id] = ch
+	}
+	return ch
+}
+
+func (c *fdChannel) deletePending(id uint32, ch chan *os.File) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending[id] == ch {
+		delete(c.pending, id)
+	}
+}
+
+// close closes the channel and the files nobody received.
+func (c *fdChannel) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	for id, ch := range c.pending {
+		select {
+		case f := <-ch:
+			f.Close()
+		default:
+		}
+		delete(c.pending, id)
+	}
+	return c.conn.Close()
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,127 @@
+package powerstrip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Host services are advertised when the host connects: once it serves
+// them, it passes their names and broker IDs to the plugin with the
+// Control.HostServices call, and the plugin keeps them with the broker of
+// that connection.
+
+// hostServiceBaseID is the first of the broker IDs reserved for host
+// services. MuxBroker.NextId never gets this far.
+const hostServiceBaseID uint32 = 1 << 31
+
+// hostServiceIDs assigns the reserved broker IDs to the host services
+// names, in the order of their names.
+func hostServiceIDs(names []string) map[string]uint32 {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	ids := make(map[string]uint32, len(sorted))
+	for i, name := range sorted {
+		ids[name] = hostServiceBaseID + uint32(i)
+	}
+	return ids
+}
+
+// assignHostServices assigns broker IDs to the host services the plugin
+// may use.
+func (c *Client) assignHostServices() error {
+	names := c.config.AllowedHostServices
+	if names == nil {
+		for name := range c.config.HostServices {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("invalid host service name: %q", name)
+		}
+		if _, ok := c.config.HostServices[name]; !ok {
+			return fmt.Errorf("unknown host service: %s", name)
+		}
+	}
+
+	c.hostServiceIDs = hostServiceIDs(names)
+	return nil
+}
+
+// serveHostServices serves the host services on their reserved broker
+// IDs, for as long as the connection lasts, and advertises them to the
+// plugin.
+func (c *RPCClient) serveHostServices(services map[string]interface{}, ids map[string]uint32) error {
+	for name, id := range ids {
+		if err := c.broker.serveService(id, name, services[name]); err != nil {
+			return fmt.Errorf("host service %s: %s", name, err)
+		}
+	}
+	if len(ids) == 0 {
+		// Plugins that don't take host services needn't know the call.
+		return nil
+	}
+
+	var empty struct{}
+	if err := c.call("Control.HostServices", ids, &empty); err != nil {
+		return fmt.Errorf("advertising host services: %s", err)
+	}
+	return nil
+}
+
+// serveService serves impl as the service name on every stream the other
+// side opens to id. Unlike AcceptAndServe, id can be dialed any number of
+// times.
+func (m *MuxBroker) serveService(id uint32, name string, impl interface{}) error {
+	server := newDispatcher(m.codec)
+	if err := server.register(name, impl); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.handlers == nil {
+		m.handlers = make(map[uint32]func(net.Conn))
+	}
+	m.handlers[id] = func(conn net.Conn) {
+		// Ack the connection, as Accept does.
+		if err := binary.Write(conn, binary.LittleEndian, id); err != nil {
+			conn.Close()
+			return
+		}
+		server.serveConn(conn)
+	}
+	return nil
+}
+
+// HostService connects to the host service name, which the host serves
+// under that name. It fails if the host doesn't offer the service to this
+// plugin. Closing the client closes the connection, not the service.
+func (m *MuxBroker) HostService(name string) (Caller, error) {
+	m.Lock()
+	id, ok := m.hostServices[name]
+	m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("host service %s isn't available", name)
+	}
+	return m.DialRPC(id)
+}
+
+// HostServices records the host services the host serves on this
+// connection, by name, with their broker IDs.
+func (c *controlServer) HostServices(
+	ids map[string]uint32, response *struct{}) error {
+	for name, id := range ids {
+		if id < hostServiceBaseID {
+			return fmt.Errorf("host service %s: broker ID %d isn't reserved for host services", name, id)
+		}
+	}
+
+	c.broker.Lock()
+	defer c.broker.Unlock()
+	c.broker.hostServices = ids
+	return nil
+}
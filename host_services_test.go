@@ -0,0 +1,218 @@
+package powerstrip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHostServicePlugin serves a plugin that logs through the host's
+// "Logger" service.
+type testHostServicePlugin struct{}
+
+func (p *testHostServicePlugin) Server(b *MuxBroker) (interface{}, error) {
+	return &testHostServiceServer{Broker: b}, nil
+}
+
+func (p *testHostServicePlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+type testHostServiceServer struct {
+	Broker *MuxBroker
+}
+
+// Log logs msg through the Logger service of the broker.
+func (s *testHostServiceServer) Log(msg string, _ *struct{}) error {
+	client, err := s.Broker.HostService("Logger")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return DecodeError(client.Call("Logger.Log", msg, &struct{}{}))
+}
+
+var testHostServicePluginMap = map[string]Plugin{
+	"host": new(testHostServicePlugin),
+}
+
+func TestRPCClient_hostServices(t *testing.T) {
+	logger := new(testLoggerImpl)
+	services := map[string]interface{}{
+		"Logger": &testLoggerServer{Impl: logger},
+	}
+	ids := hostServiceIDs([]string{"Logger"})
+
+	server := &RPCServer{
+		Plugins: testHostServicePluginMap,
+		Stdout:  new(bytes.Buffer),
+		Stderr:  new(bytes.Buffer),
+	}
+	client := testRPCServe(t, server)
+	defer client.Close()
+	if err := client.serveHostServices(services, ids); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	raw, err := client.Dispense("host")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	// Every call connects to the service anew.
+	for _, msg := range []string{"foo", "bar"} {
+		if err := c.Call("Plugin.Log", msg, &struct{}{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if !reflect.DeepEqual(logger.msgs, []string{"foo", "bar"}) {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+}
+
+func TestClient_hostServices(t *testing.T) {
+	logger := new(testLoggerImpl)
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("test-host-services"),
+		Plugins: testHostServicePluginMap,
+		HostServices: map[string]interface{}{
+			"Logger": &testLoggerServer{Impl: logger},
+		},
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("host")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = raw.(Caller).Call("Plugin.Log", "foo", &struct{}{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(logger.msgs, []string{"foo"}) {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+}
+
+func TestClient_hostServicesAllowed(t *testing.T) {
+	logger := new(testLoggerImpl)
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("test-host-services"),
+		Plugins: testHostServicePluginMap,
+		HostServices: map[string]interface{}{
+			"Logger": &testLoggerServer{Impl: logger},
+			"Other":  &testLoggerServer{Impl: logger},
+		},
+		AllowedHostServices: []string{"Other"},
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := proto.Dispense("host")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = raw.(Caller).Call("Plugin.Log", "foo", &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "isn't available") {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(logger.msgs) != 0 {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+}
+
+func TestClient_hostServicesUnknown(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:                 helperProcess("test-host-services"),
+		Plugins:             testHostServicePluginMap,
+		AllowedHostServices: []string{"Logger"},
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestHostServiceIDs(t *testing.T) {
+	ids := hostServiceIDs([]string{"b", "a"})
+	if ids["a"] != hostServiceBaseID || ids["b"] != hostServiceBaseID+1 {
+		t.Fatalf("bad: %#v", ids)
+	}
+}
+
+// testEmptyReader is an empty stream that is safe for concurrent use.
+type testEmptyReader struct{}
+
+func (testEmptyReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Every connection has the host services of its own host.
+func TestRPCServer_hostServicesPerConn(t *testing.T) {
+	// Every connection copies out the same streams, so they must be safe
+	// to read concurrently.
+	server := &RPCServer{
+		Plugins: testHostServicePluginMap,
+		Stdout:  testEmptyReader{},
+		Stderr:  testEmptyReader{},
+	}
+	ids := hostServiceIDs([]string{"Logger"})
+
+	var loggers []*testLoggerImpl
+	var callers []Caller
+	for i := 0; i < 2; i++ {
+		logger := new(testLoggerImpl)
+		client := testRPCServe(t, server)
+		defer client.Close()
+		services := map[string]interface{}{
+			"Logger": &testLoggerServer{Impl: logger},
+		}
+		if err := client.serveHostServices(services, ids); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		raw, err := client.Dispense("host")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		loggers = append(loggers, logger)
+		callers = append(callers, raw.(Caller))
+	}
+
+	for i, c := range callers {
+		if err := c.Call("Plugin.Log", fmt.Sprint(i), &struct{}{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for i, logger := range loggers {
+		if !reflect.DeepEqual(logger.msgs, []string{fmt.Sprint(i)}) {
+			t.Fatalf("bad %d: %#v", i, logger.msgs)
+		}
+	}
+
+	// A connection without host services has none.
+	client := testRPCServe(t, server)
+	defer client.Close()
+	raw, err := client.Dispense("host")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = raw.(Caller).Call("Plugin.Log", "foo", &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "isn't available") {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package powerstrip
+
+// PluginInfo describes a plugin build. A plugin sets it through
+// ServeConfig.Info, and the host fetches it with ClientProtocol.Info.
+type PluginInfo struct {
+	Name    string
+	Version string
+
+	// Commit is the VCS commit the plugin was built from.
+	Commit string
+
+	// PowerstripVersion is the version of powerstrip the plugin was built
+	// with. It is filled in by Serve.
+	PowerstripVersion string
+
+	// Labels holds any other information the plugin wants to report.
+	Labels map[string]string
+}
@@ -0,0 +1,55 @@
+package powerstrip
+
+import (
+	"context"
+)
+
+// CallInfo describes a call the plugin serves, for interceptors.
+type CallInfo struct {
+	// Service is "Control" or "Dispenser" for the calls the host makes to
+	// manage the plugin, or the name of the plugin for the calls to a
+	// dispensed implementation.
+	Service string
+
+	// Method is the name of the method called, e.g. "Double".
+	Method string
+
+	// Args is the argument of the call, and Reply the pointer the result
+	// is written to. Reply is filled in once the call's handler returns.
+	Args  interface{}
+	Reply interface{}
+}
+
+// Interceptor runs around the calls a plugin serves, to time them, log
+// them or check them before they run. It calls next to carry on with the
+// call, with ctx or a context derived from it, and returns the error the
+// host gets, which is usually what next returned. Not calling next fails
+// the call without running it.
+//
+// ctx is the context the method gets, if it takes one. For methods that
+// don't, it is still cancelled once the connection goes away.
+type Interceptor func(ctx context.Context, call *CallInfo, next func(context.Context) error) error
+
+// chainInterceptors returns the handler that runs interceptors around
+// handler, the first one outermost.
+func chainInterceptors(
+	interceptors []Interceptor, call *CallInfo, handler func(context.Context) error) func(context.Context) error {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return handler
+}
+
+// interceptorsFor returns the interceptors of the calls to service, which
+// are none if it is excluded.
+func (s *RPCServer) interceptorsFor(service string) []Interceptor {
+	for _, name := range s.SkipInterceptors {
+		if name == service {
+			return nil
+		}
+	}
+	return s.Interceptors
+}
@@ -0,0 +1,176 @@
+package powerstrip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testInterceptor records the calls it sees, as service.method.
+type testInterceptor struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (i *testInterceptor) intercept(ctx context.Context, call *CallInfo, next func(context.Context) error) error {
+	i.lock.Lock()
+	i.calls = append(i.calls, call.Service+"."+call.Method)
+	i.lock.Unlock()
+	return next(ctx)
+}
+
+func (i *testInterceptor) seen() []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]string(nil), i.calls...)
+}
+
+func testInterceptorServe(t *testing.T, interceptors []Interceptor, skip ...string) *RPCClient {
+	server := &RPCServer{
+		Plugins:          testPluginMap,
+		Stdout:           new(bytes.Buffer),
+		Stderr:           new(bytes.Buffer),
+		Interceptors:     interceptors,
+		SkipInterceptors: skip,
+	}
+	client := testRPCServe(t, server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRPCServer_interceptors(t *testing.T) {
+	var args, reply interface{}
+	var callErr error
+	recorder := new(testInterceptor)
+	inspect := func(ctx context.Context, call *CallInfo, next func(context.Context) error) error {
+		err := next(ctx)
+		if call.Method == "Double" {
+			args, callErr = call.Args, err
+			reply = reflect.ValueOf(call.Reply).Elem().Interface()
+		}
+		return err
+	}
+	client := testInterceptorServe(t, []Interceptor{recorder.intercept, inspect})
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := raw.(testInterface).Double(21); v != 42 {
+		t.Fatalf("bad: %d", v)
+	}
+
+	expected := []string{"Control.Ping", "Dispenser.Dispense", "test.Double"}
+	if calls := recorder.seen(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("bad: %#v", calls)
+	}
+	if args != 21 || reply != 42 || callErr != nil {
+		t.Fatalf("bad: %v %v %v", args, reply, callErr)
+	}
+}
+
+func TestRPCServer_interceptorsOrder(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	named := func(name string) Interceptor {
+		return func(ctx context.Context, call *CallInfo, next func(context.Context) error) error {
+			lock.Lock()
+			order = append(order, name+" before")
+			lock.Unlock()
+			err := next(ctx)
+			lock.Lock()
+			order = append(order, name+" after")
+			lock.Unlock()
+			return err
+		}
+	}
+	client := testInterceptorServe(t, []Interceptor{named("a"), named("b")})
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"a before", "b before", "b after", "a after"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("bad: %#v", order)
+	}
+}
+
+func TestRPCServer_interceptorsReject(t *testing.T) {
+	deny := func(ctx context.Context, call *CallInfo, next func(context.Context) error) error {
+		if call.Service == "test" {
+			return fmt.Errorf("%s is denied", call.Method)
+		}
+		return next(ctx)
+	}
+	client := testInterceptorServe(t, []Interceptor{deny})
+
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp int
+	err = raw.(*testInterfaceClient).Client.Call("Plugin.Double", 21, &resp)
+	if err == nil || !strings.Contains(err.Error(), "Double is denied") {
+		t.Fatalf("bad: %v", err)
+	}
+	if resp != 0 {
+		t.Fatalf("bad: %d", resp)
+	}
+}
+
+func TestRPCServer_interceptorsSkip(t *testing.T) {
+	recorder := new(testInterceptor)
+	client := testInterceptorServe(t, []Interceptor{recorder.intercept}, "Control", "Dispenser")
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw.(testInterface).Double(1)
+
+	if calls := recorder.seen(); !reflect.DeepEqual(calls, []string{"test.Double"}) {
+		t.Fatalf("bad: %#v", calls)
+	}
+
+	// Skipping the plugin skips its calls.
+	recorder = new(testInterceptor)
+	client = testInterceptorServe(t, []Interceptor{recorder.intercept}, "test")
+	raw, err = client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw.(testInterface).Double(1)
+
+	if calls := recorder.seen(); !reflect.DeepEqual(calls, []string{"Dispenser.Dispense"}) {
+		t.Fatalf("bad: %#v", calls)
+	}
+}
+
+func TestRPCServer_interceptorsPanic(t *testing.T) {
+	boom := func(ctx context.Context, call *CallInfo, next func(context.Context) error) error {
+		panic("boom")
+	}
+	client := testInterceptorServe(t, []Interceptor{boom}, "Control", "Dispenser")
+
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp int
+	err = DecodeError(raw.(*testInterfaceClient).Client.Call("Plugin.Double", 21, &resp))
+	var panicErr *RemotePanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package powerstrip
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net/rpc"
+	"reflect"
+)
+
+// InterfacePlugin is a Plugin that serves any interface through
+// reflection, instead of hand-written or generated RPC stubs.
+//
+// Every method call travels as a tuple of its arguments and a tuple of its
+// results, encoded with gob. A concrete type held in an argument or result
+// of interface type must be registered with gob.Register on both sides.
+// Methods can't take or return channels or funcs. A method that takes a
+// context.Context first gets the context of the host's call, which isn't
+// part of the tuple.
+type InterfacePlugin struct {
+	// Type is the interface type, as returned by InterfaceType.
+	Type reflect.Type
+
+	// Impl is the implementation served by the plugin. The host leaves it
+	// nil.
+	Impl interface{}
+
+	// Adapter, if set, turns the proxy into the value the host dispenses.
+	// It usually returns a struct implementing Type, whose methods call
+	// func fields filled in with InterfaceProxy.Fill. Since funcs can't be
+	// compared, it is released by passing back the value as dispensed, not
+	// a copy of it. If Adapter isn't set, the host dispenses the
+	// *InterfaceProxy.
+	Adapter func(*InterfaceProxy) (interface{}, error)
+}
+
+// InterfaceType returns the interface type ptr points to. ptr is a nil
+// pointer to the interface, as in (*Greeter)(nil).
+func InterfaceType(ptr interface{}) reflect.Type {
+	typ := reflect.TypeOf(ptr)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Interface {
+		panic(fmt.Sprintf("powerstrip: %T isn't a pointer to an interface", ptr))
+	}
+	return typ.Elem()
+}
+
+// NewInterfacePlugin returns an InterfacePlugin serving impl as the
+// interface iface points to, as in NewInterfacePlugin((*Greeter)(nil), impl).
+// impl is nil on the host.
+func NewInterfacePlugin(iface interface{}, impl interface{}) *InterfacePlugin {
+	return &InterfacePlugin{Type: InterfaceType(iface), Impl: impl}
+}
+
+func (p *InterfacePlugin) Server(*MuxBroker) (interface{}, error) {
+	methods, err := interfaceMethods(p.Type)
+	if err != nil {
+		return nil, err
+	}
+	if p.Impl == nil || !reflect.TypeOf(p.Impl).Implements(p.Type) {
+		return nil, fmt.Errorf("%T doesn't implement %s", p.Impl, p.Type)
+	}
+	return &interfaceServer{impl: reflect.ValueOf(p.Impl), methods: methods}, nil
+}
+
+func (p *InterfacePlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	methods, err := interfaceMethods(p.Type)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &InterfaceProxy{typ: p.Type, client: c, methods: methods}
+	if p.Adapter == nil {
+		return proxy, nil
+	}
+	return p.Adapter(proxy)
+}
+
+// InterfaceCall is the argument of the Call method of an InterfacePlugin.
+type InterfaceCall struct {
+	Method string
+
+	// Args is the gob encoded argument tuple.
+	Args []byte
+}
+
+// InterfaceReply is the reply of the Call method of an InterfacePlugin.
+type InterfaceReply struct {
+	// Results is the gob encoded result tuple, without the error.
+	Results []byte
+
+	// Err is the error the method returned, encoded as a response error,
+	// or nil.
+	Err *string
+}
+
+// interfaceMethod describes a method of an InterfacePlugin's interface.
+type interfaceMethod struct {
+	name string
+	typ  reflect.Type
+
+	// ctx is set if the method takes a context.Context first, and err if
+	// it returns an error last.
+	ctx bool
+	err bool
+
+	// args and results are the struct types of the tuples, with a field
+	// per argument or result.
+	args    reflect.Type
+	results reflect.Type
+}
+
+// interfaceMethods describes the methods of the interface typ.
+func interfaceMethods(typ reflect.Type) (map[string]*interfaceMethod, error) {
+	if typ == nil || typ.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("%v isn't an interface type", typ)
+	}
+
+	methods := make(map[string]*interfaceMethod, typ.NumMethod())
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		m := &interfaceMethod{name: method.Name, typ: method.Type}
+
+		var in, out []reflect.Type
+		for j := 0; j < m.typ.NumIn(); j++ {
+			in = append(in, m.typ.In(j))
+		}
+		for j := 0; j < m.typ.NumOut(); j++ {
+			out = append(out, m.typ.Out(j))
+		}
+		if len(in) > 0 && in[0] == typeOfContext {
+			m.ctx = true
+			in = in[1:]
+		}
+		if len(out) > 0 && out[len(out)-1] == typeOfError {
+			m.err = true
+			out = out[:len(out)-1]
+		}
+
+		var err error
+		if m.args, err = tupleType("A", in); err != nil {
+			return nil, fmt.Errorf("method %s: %s", m.name, err)
+		}
+		if m.results, err = tupleType("R", out); err != nil {
+			return nil, fmt.Errorf("method %s: %s", m.name, err)
+		}
+		methods[m.name] = m
+	}
+	return methods, nil
+}
+
+// tupleType returns a struct type with a field for each of types, named
+// after prefix and the position of the field.
+func tupleType(prefix string, types []reflect.Type) (reflect.Type, error) {
+	fields := make([]reflect.StructField, len(types))
+	for i, t := range types {
+		switch t.Kind() {
+		case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			return nil, fmt.Errorf("%s can't be sent", t)
+		}
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("%s%d", prefix, i), Type: t}
+	}
+	return reflect.StructOf(fields), nil
+}
+
+// encodeTuple gob encodes vals as a tuple of type typ.
+func encodeTuple(typ reflect.Type, vals []reflect.Value) ([]byte, error) {
+	tuple := reflect.New(typ).Elem()
+	for i, v := range vals {
+		tuple.Field(i).Set(v)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(tuple); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeTuple decodes a tuple of type typ encoded by encodeTuple, and
+// returns its fields.
+func decodeTuple(typ reflect.Type, data []byte) ([]reflect.Value, error) {
+	tuple := reflect.New(typ)
+	if err := gob.NewDecoder(bytes.NewReader(data)).DecodeValue(tuple); err != nil {
+		return nil, err
+	}
+
+	vals := make([]reflect.Value, typ.NumField())
+	for i := range vals {
+		vals[i] = tuple.Elem().Field(i)
+	}
+	return vals, nil
+}
+
+// interfaceServer serves the implementation of an InterfacePlugin.
+type interfaceServer struct {
+	impl    reflect.Value
+	methods map[string]*interfaceMethod
+}
+
+func (s *interfaceServer) Call(ctx context.Context, args *InterfaceCall, reply *InterfaceReply) error {
+	m, ok := s.methods[args.Method]
+	if !ok {
+		return fmt.Errorf("unknown method: %s", args.Method)
+	}
+
+	in, err := decodeTuple(m.args, args.Args)
+	if err != nil {
+		return fmt.Errorf("method %s: decoding arguments: %s", m.name, err)
+	}
+	if m.ctx {
+		in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+	}
+
+	fn := s.impl.MethodByName(m.name)
+	var out []reflect.Value
+	if m.typ.IsVariadic() {
+		out = fn.CallSlice(in)
+	} else {
+		out = fn.Call(in)
+	}
+
+	if m.err {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			msg := encodeError(err)
+			reply.Err = &msg
+		}
+		out = out[:len(out)-1]
+	}
+	reply.Results, err = encodeTuple(m.results, out)
+	if err != nil {
+		return fmt.Errorf("method %s: encoding results: %s", m.name, err)
+	}
+	return nil
+}
+
+// InterfaceProxy is the host side of an InterfacePlugin. It calls the
+// methods of the plugin's implementation by name.
+type InterfaceProxy struct {
+	typ     reflect.Type
+	client  Caller
+	methods map[string]*interfaceMethod
+}
+
+// Type returns the interface type of the plugin.
+func (p *InterfaceProxy) Type() reflect.Type {
+	return p.typ
+}
+
+// Call calls method with args, and returns its results without the
+// trailing error. The call gives up once ctx is done, and a method taking
+// a context.Context first is passed ctx for it, with args the rest of its
+// arguments. The last argument of a variadic method is a slice. The error
+// is the one the method returned, or why the call failed, including a
+// panic in the plugin as a RemotePanicError.
+func (p *InterfaceProxy) Call(
+	ctx context.Context, method string, args ...interface{}) ([]interface{}, error) {
+	m, ok := p.methods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown method: %s", method)
+	}
+
+	n := m.args.NumField()
+	if len(args) != n {
+		return nil, fmt.Errorf("method %s: takes %d arguments, got %d", method, n, len(args))
+	}
+	in := make([]reflect.Value, n)
+	for i, arg := range args {
+		v := reflect.New(m.args.Field(i).Type).Elem()
+		if arg != nil {
+			av := reflect.ValueOf(arg)
+			if !av.Type().AssignableTo(v.Type()) {
+				return nil, fmt.Errorf("method %s: argument %d is %T, not %s", method, i, arg, v.Type())
+			}
+			v.Set(av)
+		}
+		in[i] = v
+	}
+
+	out, err := p.call(ctx, m, in)
+	results := make([]interface{}, len(out))
+	for i, v := range out {
+		results[i] = v.Interface()
+	}
+	return results, err
+}
+
+// Fill sets every func field of the struct funcs points to, to a func that
+// calls the method of the same name. Each field must have the type of its
+// method. The funcs return the errors Call would, in place of the error
+// the method returns, and panic with them if the method returns none.
+func (p *InterfaceProxy) Fill(funcs interface{}) error {
+	v := reflect.ValueOf(funcs)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%T isn't a pointer to a struct", funcs)
+	}
+	v = v.Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.Func || field.PkgPath != "" {
+			continue
+		}
+		m, ok := p.methods[field.Name]
+		if !ok {
+			return fmt.Errorf("field %s: %s has no method %s", field.Name, p.typ, field.Name)
+		}
+		if field.Type != m.typ {
+			return fmt.Errorf("field %s: is %s, method is %s", field.Name, field.Type, m.typ)
+		}
+		v.Field(i).Set(p.makeFunc(m))
+	}
+	return nil
+}
+
+// makeFunc returns a func of the type of m that calls it.
+func (p *InterfaceProxy) makeFunc(m *interfaceMethod) reflect.Value {
+	return reflect.MakeFunc(m.typ, func(in []reflect.Value) []reflect.Value {
+		ctx := context.Background()
+		if m.ctx {
+			if c, _ := in[0].Interface().(context.Context); c != nil {
+				ctx = c
+			}
+			in = in[1:]
+		}
+
+		results, err := p.call(ctx, m, in)
+		if err != nil && !m.err {
+			panic(err)
+		}
+
+		out := make([]reflect.Value, m.typ.NumOut())
+		for i := range out {
+			if i < len(results) {
+				out[i] = results[i]
+			} else {
+				out[i] = reflect.Zero(m.typ.Out(i))
+			}
+		}
+		if m.err && err != nil {
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	})
+}
+
+// call calls m with in, the arguments without the context, and returns
+// its results without the trailing error. The results are nil if the call
+// failed. A panic on this side, in an interceptor say, isn't the plugin's:
+// it is returned as a plain error if m returns one, and goes on otherwise.
+func (p *InterfaceProxy) call(
+	ctx context.Context, m *interfaceMethod, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !m.err {
+				panic(r)
+			}
+			out, err = nil, fmt.Errorf("method %s: panic: %v", m.name, r)
+		}
+	}()
+
+	args, err := encodeTuple(m.args, in)
+	if err != nil {
+		return nil, fmt.Errorf("method %s: encoding arguments: %s", m.name, err)
+	}
+
+	var reply InterfaceReply
+	err = p.client.CallContext(ctx, "Plugin.Call", &InterfaceCall{Method: m.name, Args: args}, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if out, err = decodeTuple(m.results, reply.Results); err != nil {
+		return nil, fmt.Errorf("method %s: decoding results: %s", m.name, err)
+	}
+	if reply.Err != nil {
+		err = DecodeError(rpc.ServerError(*reply.Err))
+	}
+	return out, err
+}
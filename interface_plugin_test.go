@@ -0,0 +1,341 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCalc is the interface served with an InterfacePlugin in the tests.
+type testCalc interface {
+	Add(a, b int) int
+	Div(a, b int) (int, error)
+	Join(sep string, parts ...string) string
+	Lookup(m map[string]*testCalcEntry, key string) *testCalcEntry
+	Wait(ctx context.Context) error
+	Crash()
+	CrashErr() error
+}
+
+type testCalcEntry struct {
+	Name string
+}
+
+type testCalcImpl struct{}
+
+func (testCalcImpl) Add(a, b int) int { return a + b }
+
+func (testCalcImpl) Div(a, b int) (int, error) {
+	if b == 0 {
+		return a, testErrSentinel
+	}
+	return a / b, nil
+}
+
+func (testCalcImpl) Join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func (testCalcImpl) Lookup(m map[string]*testCalcEntry, key string) *testCalcEntry {
+	return m[key]
+}
+
+func (testCalcImpl) Wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (testCalcImpl) Crash() { panic("crash") }
+
+func (testCalcImpl) CrashErr() error { panic("crash") }
+
+// testCalcFuncs is filled with InterfaceProxy.Fill.
+type testCalcFuncs struct {
+	Add      func(a, b int) int
+	Div      func(a, b int) (int, error)
+	Join     func(sep string, parts ...string) string
+	Lookup   func(m map[string]*testCalcEntry, key string) *testCalcEntry
+	Wait     func(ctx context.Context) error
+	Crash    func()
+	CrashErr func() error
+
+	ignored int
+}
+
+// testCalcAdapter implements testCalc on the host.
+type testCalcAdapter struct {
+	f testCalcFuncs
+}
+
+func (a *testCalcAdapter) Add(x, y int) int                    { return a.f.Add(x, y) }
+func (a *testCalcAdapter) Div(x, y int) (int, error)           { return a.f.Div(x, y) }
+func (a *testCalcAdapter) Join(sep string, p ...string) string { return a.f.Join(sep, p...) }
+func (a *testCalcAdapter) Lookup(m map[string]*testCalcEntry, k string) *testCalcEntry {
+	return a.f.Lookup(m, k)
+}
+func (a *testCalcAdapter) Wait(ctx context.Context) error { return a.f.Wait(ctx) }
+func (a *testCalcAdapter) Crash()                         { a.f.Crash() }
+func (a *testCalcAdapter) CrashErr() error                { return a.f.CrashErr() }
+
+func testCalcPlugin() *InterfacePlugin {
+	p := NewInterfacePlugin((*testCalc)(nil), testCalcImpl{})
+	p.Adapter = func(proxy *InterfaceProxy) (interface{}, error) {
+		a := new(testCalcAdapter)
+		if err := proxy.Fill(&a.f); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return p
+}
+
+func TestInterfacePlugin_proxy(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": NewInterfacePlugin((*testCalc)(nil), testCalcImpl{}),
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("calc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	proxy, ok := raw.(*InterfaceProxy)
+	if !ok {
+		t.Fatalf("bad: %#v", raw)
+	}
+	if proxy.Type() != reflect.TypeOf((*testCalc)(nil)).Elem() {
+		t.Fatalf("bad: %s", proxy.Type())
+	}
+
+	results, err := proxy.Call(context.Background(), "Add", 1, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{3}) {
+		t.Fatalf("bad: %#v", results)
+	}
+
+	results, err = proxy.Call(context.Background(), "Join", "-", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{"a-b"}) {
+		t.Fatalf("bad: %#v", results)
+	}
+
+	// The results of a method that fails still come back.
+	results, err = proxy.Call(context.Background(), "Div", 7, 0)
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{7}) {
+		t.Fatalf("bad: %#v", results)
+	}
+
+	if _, err := proxy.Call(context.Background(), "Add", 1); err == nil {
+		t.Fatal("should error")
+	}
+	if _, err := proxy.Call(context.Background(), "Add", 1, "2"); err == nil {
+		t.Fatal("should error")
+	}
+	if _, err := proxy.Call(context.Background(), "Nope"); err == nil {
+		t.Fatal("should error")
+	}
+
+	if err := client.Release(raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestInterfacePlugin_adapter(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": testCalcPlugin(),
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("calc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	calc, ok := raw.(testCalc)
+	if !ok {
+		t.Fatalf("bad: %#v", raw)
+	}
+
+	if v := calc.Add(2, 3); v != 5 {
+		t.Fatalf("bad: %d", v)
+	}
+	if v, err := calc.Div(6, 3); err != nil || v != 2 {
+		t.Fatalf("bad: %d %v", v, err)
+	}
+	if _, err := calc.Div(1, 0); !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+	if v := calc.Join(",", "a", "b", "c"); v != "a,b,c" {
+		t.Fatalf("bad: %q", v)
+	}
+	if v := calc.Join(","); v != "" {
+		t.Fatalf("bad: %q", v)
+	}
+
+	m := map[string]*testCalcEntry{"a": {Name: "A"}}
+	if v := calc.Lookup(m, "a"); v == nil || v.Name != "A" {
+		t.Fatalf("bad: %#v", v)
+	}
+	if v := calc.Lookup(m, "b"); v != nil {
+		t.Fatalf("bad: %#v", v)
+	}
+
+	if err := client.Release(raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestInterfacePlugin_context(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": testCalcPlugin(),
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("calc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	calc := raw.(testCalc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// Either side may see the deadline first.
+	if err := calc.Wait(ctx); err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestInterfacePlugin_panic(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": testCalcPlugin(),
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("calc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	calc := raw.(testCalc)
+
+	// A method returning an error gets the panic as its error.
+	var perr *RemotePanicError
+	if err := calc.CrashErr(); !errors.As(err, &perr) {
+		t.Fatalf("bad: %v", err)
+	}
+	if perr.Value != "crash" {
+		t.Fatalf("bad: %#v", perr)
+	}
+
+	// Other methods panic with it.
+	func() {
+		defer func() {
+			r := recover()
+			if _, ok := r.(error); !ok || !errors.As(r.(error), &perr) {
+				t.Fatalf("bad: %#v", r)
+			}
+		}()
+		calc.Crash()
+	}()
+
+	// The plugin still serves calls.
+	if v := calc.Add(1, 1); v != 2 {
+		t.Fatalf("bad: %d", v)
+	}
+}
+
+// A panic on the host is the host's, and not reported as the plugin's.
+func TestInterfacePlugin_localPanic(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": testCalcPlugin(),
+	})
+	defer client.Close()
+	client.interceptors = []ClientInterceptor{
+		func(ctx context.Context, call *ClientCall, invoke func(context.Context) error) error {
+			if call.Plugin == "calc" {
+				panic("local")
+			}
+			return invoke(ctx)
+		},
+	}
+
+	raw, err := client.Dispense("calc")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	calc := raw.(testCalc)
+
+	// A method returning an error returns the panic, but not as the
+	// plugin's.
+	err = calc.CrashErr()
+	if err == nil || !strings.Contains(err.Error(), "local") {
+		t.Fatalf("bad: %v", err)
+	}
+	var perr *RemotePanicError
+	if errors.As(err, &perr) {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	// Others panic on.
+	defer func() {
+		if r := recover(); r != "local" {
+			t.Fatalf("bad: %#v", r)
+		}
+	}()
+	calc.Crash()
+	t.Fatal("should panic")
+}
+
+func TestInterfacePlugin_badImpl(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"calc": NewInterfacePlugin((*testCalc)(nil), struct{}{}),
+	})
+	defer client.Close()
+
+	if _, err := client.Dispense("calc"); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestInterfaceProxy_Fill(t *testing.T) {
+	proxy := &InterfaceProxy{typ: reflect.TypeOf((*testCalc)(nil)).Elem()}
+	var err error
+	if proxy.methods, err = interfaceMethods(proxy.typ); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := proxy.Fill(testCalcFuncs{}); err == nil {
+		t.Fatal("should error")
+	}
+
+	var unknown struct {
+		Sub func(a, b int) int
+	}
+	if err := proxy.Fill(&unknown); err == nil {
+		t.Fatal("should error")
+	}
+
+	var mismatched struct {
+		Add func(a, b int64) int64
+	}
+	if err := proxy.Fill(&mismatched); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestInterfaceMethods_unsendable(t *testing.T) {
+	type bad interface {
+		Watch() chan int
+	}
+	if _, err := interfaceMethods(reflect.TypeOf((*bad)(nil)).Elem()); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -3,6 +3,7 @@ package powerstrip
 import (
 	"encoding/binary"
 	"fmt"
+	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -21,13 +22,35 @@ type MuxBroker struct {
 	session *mux.Session
 	streams map[uint32]*muxBrokerPending
 
+	// codec is the codec of the connection, which AcceptAndServe and
+	// DialRPC use too.
+	codec string
+
+	// handlers serve the streams opened to the IDs of long-lived services,
+	// instead of handing them to Accept.
+	handlers map[uint32]func(net.Conn)
+
+	// hostServices maps the names of the host services the plugin may use
+	// to their broker IDs, as the host advertised them. It is protected by
+	// the lock.
+	hostServices map[string]uint32
+
+	// fds is the channel SendFile and ReceiveFile pass descriptors on,
+	// or nil with the reason in fdErr if there can't be one. fdOpen opens
+	// it, once it is first needed, under fdOpenLock.
+	fds        *fdChannel
+	fdErr      error
+	fdOpen     func() error
+	fdOpenLock sync.Mutex
+
 	sync.Mutex
 }
 
-func newMuxBroker(s *mux.Session) *MuxBroker {
+func newMuxBroker(s *mux.Session, codec string) *MuxBroker {
 	return &MuxBroker{
 		session: s,
 		streams: make(map[uint32]*muxBrokerPending),
+		codec:   codec,
 	}
 }
 
@@ -54,6 +77,43 @@ func (m *MuxBroker) Accept(id uint32) (net.Conn, error) {
 	return c, nil
 }
 
+// AcceptAndServe accepts the stream id and serves impl on it as the
+// service name, until the other side closes it. It blocks, so it is
+// usually run in its own goroutine while the call that hands id to the
+// other side is in progress. impl is served like a dispensed
+// implementation: its methods may take a context.Context, and its errors
+// and panics travel as they do for dispensed plugins.
+func (m *MuxBroker) AcceptAndServe(id uint32, name string, impl interface{}) {
+	server := newDispatcher(m.codec)
+	if err := server.register(name, impl); err != nil {
+		log.Printf("[ERR] plugin: serving %s on broker stream %d: %s", name, id, err)
+		return
+	}
+
+	conn, err := m.Accept(id)
+	if err != nil {
+		log.Printf("[ERR] plugin: serving %s on broker stream %d: %s", name, id, err)
+		return
+	}
+	server.serveConn(conn)
+}
+
+// DialRPC connects to the stream id, on which the other side serves with
+// AcceptAndServe, and returns a client for it. Its call errors are decoded
+// with DecodeError. Closing the client ends the serving side.
+func (m *MuxBroker) DialRPC(id uint32) (Caller, error) {
+	conn, err := m.Dial(id)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := newCaller(m.codec, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return caller, nil
+}
+
 func (m *MuxBroker) getStream(id uint32) *muxBrokerPending {
 	m.Lock()
 	defer m.Unlock()
@@ -71,6 +131,11 @@ func (m *MuxBroker) getStream(id uint32) *muxBrokerPending {
 }
 
 func (m *MuxBroker) Close() error {
+	m.Lock()
+	if m.fds != nil {
+		m.fds.close()
+	}
+	m.Unlock()
 	return m.session.Close()
 }
 
@@ -116,6 +181,14 @@ func (m *MuxBroker) Run() {
 			continue
 		}
 
+		m.Lock()
+		handler := m.handlers[id]
+		m.Unlock()
+		if handler != nil {
+			go handler(stream)
+			continue
+		}
+
 		// Initialize the waiter
 		p := m.getStream(id)
 		select {
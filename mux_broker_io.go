@@ -0,0 +1,385 @@
+package powerstrip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// The frames a stream is sent in. A data frame carries a chunk of the
+// stream, an EOF frame ends it, and an error frame ends it with the error
+// in its payload, encoded like a response error.
+const (
+	frameData byte = iota
+	frameEOF
+	frameError
+)
+
+// frameHeaderSize is the size of the frame type and the big endian uint32
+// payload length.
+const frameHeaderSize = 5
+
+// maxFrameSize is the largest data frame sent.
+const maxFrameSize = 32 * 1024
+
+// maxErrorFrameSize is the largest error frame payload sent or read. The
+// reader holds the whole payload, so its size can't be left to the peer.
+const maxErrorFrameSize = 4 * 1024
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	copy(frame[frameHeaderSize:], payload)
+	return sendFrame(w, typ, frame)
+}
+
+// sendFrame fills in the header of frame, whose payload follows the room
+// left for the header, and writes it. Data frames are built in place this
+// way, to avoid copying them.
+func sendFrame(w io.Writer, typ byte, frame []byte) error {
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(frame)-frameHeaderSize))
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeEnd ends a stream with err, or with EOF if err is nil.
+func writeEnd(w io.Writer, err error) error {
+	if err == nil {
+		return writeFrame(w, frameEOF, nil)
+	}
+	msg := encodeError(err)
+	if len(msg) > maxErrorFrameSize {
+		// Send what fits of the message, without the code it had.
+		msg = err.Error()
+		if len(msg) > maxErrorFrameSize {
+			msg = msg[:maxErrorFrameSize]
+		}
+	}
+	return writeFrame(w, frameError, []byte(msg))
+}
+
+// frameReader reads the data of a stream of frames, up to its end.
+type frameReader struct {
+	r io.Reader
+
+	// remaining is what is left of the current data frame.
+	remaining uint32
+
+	// err is returned once the data is read: io.EOF, the error the
+	// stream ended with, or why it couldn't be read.
+	err error
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.readHeader()
+	}
+
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= uint32(n)
+	if err != nil {
+		r.fail(err)
+		r.remaining = 0
+	}
+	return n, nil
+}
+
+// readHeader reads the next frame header, and the payload of a frame
+// that ends the stream.
+func (r *frameReader) readHeader() {
+	var h [frameHeaderSize]byte
+	if _, err := io.ReadFull(r.r, h[:]); err != nil {
+		r.fail(err)
+		return
+	}
+	n := binary.BigEndian.Uint32(h[1:])
+
+	switch h[0] {
+	case frameData:
+		r.remaining = n
+	case frameEOF:
+		r.err = io.EOF
+	case frameError:
+		if n > maxErrorFrameSize {
+			r.err = fmt.Errorf("stream error of %d bytes is too large", n)
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r.r, msg); err != nil {
+			r.fail(err)
+			return
+		}
+		r.err = DecodeError(rpc.ServerError(msg))
+	default:
+		r.err = fmt.Errorf("bad stream frame type %d", h[0])
+	}
+}
+
+// fail ends the stream with the error it couldn't be read with.
+func (r *frameReader) fail(err error) {
+	if err == io.EOF {
+		// The stream was cut short.
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+}
+
+// closeWithError closes v with err, if it can be closed.
+func closeWithError(v interface{}, err error) error {
+	if c, ok := v.(interface{ CloseWithError(error) error }); ok && err != nil {
+		return c.CloseWithError(err)
+	}
+	if c, ok := v.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeOnFinish closes conn once the other side closes it, which it only
+// does when it is done with the stream. That unblocks a write waiting for
+// window the other side will never give back.
+func closeOnFinish(conn net.Conn) {
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+}
+
+// ServeReader serves r to the other side on a new broker stream, and
+// returns the stream ID to pass on to it for DialReader. The other side
+// reads r up to its EOF or error. r is closed, if it is an io.Closer, once
+// it is read or the other side closes its reader.
+func (m *MuxBroker) ServeReader(r io.Reader) uint32 {
+	id := m.NextId()
+	go func() {
+		conn, err := m.Accept(id)
+		if err != nil {
+			log.Printf("[ERR] plugin: serving reader on broker stream %d: %s", id, err)
+			closeWithError(r, nil)
+			return
+		}
+		defer conn.Close()
+		go closeOnFinish(conn)
+
+		buf := make([]byte, frameHeaderSize+maxFrameSize)
+		for {
+			n, err := r.Read(buf[frameHeaderSize:])
+			if n > 0 {
+				if werr := sendFrame(conn, frameData, buf[:frameHeaderSize+n]); werr != nil {
+					// The other side went away or closed its reader.
+					closeWithError(r, nil)
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				writeEnd(conn, err)
+				closeWithError(r, nil)
+				return
+			}
+		}
+	}()
+	return id
+}
+
+// DialReader connects to the reader the other side serves with
+// ServeReader on the stream id. Reads return its data, then io.EOF or the
+// error it failed with, decoded like a call error. The reader must be
+// closed, and closing it before the end tells the other side to stop.
+func (m *MuxBroker) DialReader(id uint32) (io.ReadCloser, error) {
+	conn, err := m.Dial(id)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{frameReader: frameReader{r: conn}, conn: conn}, nil
+}
+
+// streamReader is the reader DialReader returns.
+type streamReader struct {
+	frameReader
+	conn net.Conn
+}
+
+func (r *streamReader) Close() error {
+	return r.conn.Close()
+}
+
+// ServeWriter serves w to the other side on a new broker stream, and
+// returns the stream ID to pass on to it for DialWriter. What the other
+// side writes is written to w. w is closed, if it is an io.Closer, once
+// the other side closes its writer, and the error of that is returned to
+// it. If the other side fails or goes away first, w is closed with that
+// error if it has a CloseWithError method, like io.PipeWriter, or just
+// closed otherwise.
+func (m *MuxBroker) ServeWriter(w io.Writer) uint32 {
+	id := m.NextId()
+	go func() {
+		conn, err := m.Accept(id)
+		if err != nil {
+			log.Printf("[ERR] plugin: serving writer on broker stream %d: %s", id, err)
+			closeWithError(w, err)
+			return
+		}
+		defer conn.Close()
+
+		r := &frameReader{r: conn}
+		buf := make([]byte, maxFrameSize)
+		for {
+			n, rerr := r.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					// Tell the other side, which stops writing once it
+					// sees the error and closes the stream.
+					writeEnd(conn, werr)
+					closeWithError(w, werr)
+					io.Copy(ioutil.Discard, conn)
+					return
+				}
+			}
+			if rerr != nil {
+				// The other side closed its writer, with an error if it
+				// failed. Tell it how closing w went.
+				if rerr == io.EOF {
+					rerr = nil
+				}
+				writeEnd(conn, closeWithError(w, rerr))
+				return
+			}
+		}
+	}()
+	return id
+}
+
+// DialWriter connects to the writer the other side serves with
+// ServeWriter on the stream id.
+func (m *MuxBroker) DialWriter(id uint32) (*StreamWriter, error) {
+	conn, err := m.Dial(id)
+	if err != nil {
+		return nil, err
+	}
+	w := &StreamWriter{conn: conn, doneCh: make(chan struct{})}
+	go w.waitEnd()
+	return w, nil
+}
+
+// StreamWriter writes to a writer the other side serves with
+// ServeWriter. Writes are sent in chunks over the stream, subject to its
+// flow control.
+type StreamWriter struct {
+	conn net.Conn
+
+	// doneCh is closed once the other side ended the stream, with err.
+	doneCh chan struct{}
+	err    error
+
+	lock   sync.Mutex
+	closed bool
+	buf    []byte
+}
+
+// errStreamEnded is returned by a StreamWriter that the other side ended
+// without an error before it was closed.
+var errStreamEnded = errors.New("stream ended by the other side")
+
+// waitEnd waits for the other side to end the stream, with the result of
+// closing its writer or the error it failed with.
+func (w *StreamWriter) waitEnd() {
+	r := &frameReader{r: w.conn}
+	_, err := io.Copy(ioutil.Discard, r)
+	w.err = err
+	close(w.doneCh)
+
+	// The other side is done, so stop a write waiting for window.
+	w.conn.Close()
+}
+
+// ended returns the error the stream ended with, or nil if it didn't end.
+func (w *StreamWriter) ended() (bool, error) {
+	select {
+	case <-w.doneCh:
+		if w.err == nil {
+			return true, errStreamEnded
+		}
+		return true, w.err
+	default:
+		return false, nil
+	}
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if ended, err := w.ended(); ended {
+			return written, err
+		}
+
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, frameHeaderSize+maxFrameSize)
+		}
+		n := copy(w.buf[frameHeaderSize:], chunk)
+		if err := sendFrame(w.conn, frameData, w.buf[:frameHeaderSize+n]); err != nil {
+			if ended, endErr := w.ended(); ended {
+				return written, endErr
+			}
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the stream, and returns the error of closing the writer on
+// the other side, or the error the stream failed with.
+func (w *StreamWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError ends the stream with err, which the other side closes
+// its writer with, if it has a CloseWithError method. With a nil err it
+// is Close.
+func (w *StreamWriter) CloseWithError(err error) error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return io.ErrClosedPipe
+	}
+	w.closed = true
+	w.lock.Unlock()
+
+	if ended, endErr := w.ended(); ended {
+		if endErr == errStreamEnded {
+			endErr = nil
+		}
+		return endErr
+	}
+
+	if werr := writeEnd(w.conn, err); werr != nil {
+		w.conn.Close()
+		return werr
+	}
+	<-w.doneCh
+	return w.err
+}
@@ -0,0 +1,302 @@
+package powerstrip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeroFruit/powerstrip/mux"
+)
+
+// testBrokers returns the brokers of both ends of a connection.
+func testBrokers(t *testing.T) (*MuxBroker, *MuxBroker) {
+	clientConn, serverConn := net.Pipe()
+
+	serverCh := make(chan *mux.Session, 1)
+	go func() {
+		mx, err := mux.Server(serverConn, nil)
+		if err != nil {
+			t.Errorf("err: %s", err)
+		}
+		serverCh <- mx
+	}()
+	mx, err := mux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client := newMuxBroker(mx, CodecGob)
+	server := newMuxBroker(<-serverCh, CodecGob)
+	go client.Run()
+	go server.Run()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// testCloser records that it was closed.
+type testCloser struct {
+	io.Reader
+	io.Writer
+
+	closeCh chan struct{}
+	err     error
+}
+
+func newTestCloser(r io.Reader, w io.Writer) *testCloser {
+	return &testCloser{Reader: r, Writer: w, closeCh: make(chan struct{})}
+}
+
+func (c *testCloser) Close() error {
+	close(c.closeCh)
+	return c.err
+}
+
+func (c *testCloser) waitClosed(t *testing.T) {
+	select {
+	case <-c.closeCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed")
+	}
+}
+
+// testFailReader returns its data, then err.
+type testFailReader struct {
+	data []byte
+	err  error
+}
+
+func (r *testFailReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// testFailWriter fails every write with err.
+type testFailWriter struct {
+	err error
+}
+
+func (w *testFailWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestMuxBroker_reader(t *testing.T) {
+	client, server := testBrokers(t)
+
+	// More than the stream window, so that flow control kicks in.
+	data := testData(1 << 20)
+	src := newTestCloser(bytes.NewReader(data), nil)
+	id := server.ServeReader(src)
+
+	r, err := client.DialReader(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bad: %d bytes", len(got))
+	}
+	src.waitClosed(t)
+
+	// EOF sticks.
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestMuxBroker_readerError(t *testing.T) {
+	client, server := testBrokers(t)
+
+	id := server.ServeReader(&testFailReader{data: []byte("foo"), err: testErrSentinel})
+	r, err := client.DialReader(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+	if string(got) != "foo" {
+		t.Fatalf("bad: %q", got)
+	}
+}
+
+func TestFrameReader_errorSize(t *testing.T) {
+	// A long error is cut down to what an error frame holds.
+	var buf bytes.Buffer
+	if err := writeEnd(&buf, errors.New(strings.Repeat("x", 2*maxErrorFrameSize))); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, err := ioutil.ReadAll(&frameReader{r: &buf})
+	if err == nil || len(err.Error()) != maxErrorFrameSize {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A larger one isn't read.
+	buf.Reset()
+	buf.Write([]byte{frameError, 0xff, 0xff, 0xff, 0xff})
+	_, err = ioutil.ReadAll(&frameReader{r: &buf})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_readerClose(t *testing.T) {
+	client, server := testBrokers(t)
+
+	// A reader that never ends.
+	src := newTestCloser(rand.New(rand.NewSource(1)), nil)
+	id := server.ServeReader(src)
+
+	r, err := client.DialReader(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Closing the reader stops the other side, even though it is waiting
+	// for window.
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	src.waitClosed(t)
+}
+
+func TestMuxBroker_writer(t *testing.T) {
+	client, server := testBrokers(t)
+
+	data := testData(1 << 20)
+	var buf bytes.Buffer
+	dst := newTestCloser(nil, &buf)
+	id := server.ServeWriter(dst)
+
+	w, err := client.DialWriter(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Close waits for the other side to be done.
+	select {
+	case <-dst.closeCh:
+	default:
+		t.Fatal("not closed")
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("bad: %d bytes", buf.Len())
+	}
+
+	if _, err := w.Write(data); err != io.ErrClosedPipe {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_writerCloseError(t *testing.T) {
+	client, server := testBrokers(t)
+
+	dst := newTestCloser(nil, ioutil.Discard)
+	dst.err = testErrSentinel
+	id := server.ServeWriter(dst)
+
+	w, err := client.DialWriter(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.Close(); !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_writerWriteError(t *testing.T) {
+	client, server := testBrokers(t)
+
+	id := server.ServeWriter(&testFailWriter{err: testErrSentinel})
+	w, err := client.DialWriter(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The error comes back once the other side fails, even though it
+	// stops reading.
+	data := testData(maxFrameSize)
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, err = w.Write(data); err != nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("no error")
+		default:
+		}
+	}
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMuxBroker_writerCloseWithError(t *testing.T) {
+	client, server := testBrokers(t)
+
+	pr, pw := io.Pipe()
+	id := server.ServeWriter(pw)
+
+	w, err := client.DialWriter(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(pr)
+		errCh <- err
+	}()
+
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.CloseWithError(testErrSentinel); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := <-errCh; !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -1,8 +1,73 @@
 package powerstrip
 
-import "net/rpc"
-
 type Plugin interface {
 	Server(*MuxBroker) (interface{}, error)
-	Client(*MuxBroker, *rpc.Client) (interface{}, error)
+	Client(*MuxBroker, Caller) (interface{}, error)
+}
+
+// ServerWithArgs is implemented by plugins that take configuration when
+// they are dispensed, so that every dispensed instance can be configured
+// on its own. It is used instead of Plugin.Server, and args is whatever
+// the host passed to ClientProtocol.DispenseWithArgs, or nil.
+//
+// args is encoded with the codec of the connection. With gob, a concrete
+// type other than the builtin ones must be registered with gob.Register on
+// both sides. With jsonrpc, it arrives as the decoded JSON value, like a
+// map[string]interface{} for an object.
+type ServerWithArgs interface {
+	ServerWithArgs(b *MuxBroker, args interface{}) (interface{}, error)
+}
+
+// DispenseRequest is the argument of the Dispenser.DispenseWithArgs call.
+// Args is encoded with the codec of the connection, like the rest of it.
+//
+// Dispenser.Dispense keeps taking the bare plugin name: changing its
+// argument would break it between hosts and plugins built before args
+// existed, which don't decode one into the other. This way Dispense still
+// works across versions, and only DispenseWithArgs needs a plugin that
+// knows about args.
+type DispenseRequest struct {
+	Name string
+	Args interface{}
+}
+
+// CapabilityPlugin is implemented by plugins that describe what they can
+// do, so that the host can find out through ClientProtocol.List.
+type CapabilityPlugin interface {
+	Plugin
+
+	// Capabilities returns free-form capability metadata.
+	Capabilities() map[string]string
+}
+
+// wrappedPlugin is implemented by the plugins that wrap another one to add
+// to it, like WithDispensePolicy returns. They only implement the optional
+// plugin interfaces they add; lookupPlugin finds the others.
+type wrappedPlugin interface {
+	unwrap() Plugin
+}
+
+// lookupPlugin returns the first of p and the plugins it wraps that
+// implements I, an optional plugin interface.
+func lookupPlugin[I any](p Plugin) (I, bool) {
+	for p != nil {
+		if i, ok := p.(I); ok {
+			return i, true
+		}
+		w, ok := p.(wrappedPlugin)
+		if !ok {
+			break
+		}
+		p = w.unwrap()
+	}
+	var zero I
+	return zero, false
+}
+
+// PluginDescriptor describes a plugin the server can dispense.
+type PluginDescriptor struct {
+	Name string
+
+	// Capabilities is set if the plugin implements CapabilityPlugin.
+	Capabilities map[string]string
 }
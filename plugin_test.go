@@ -1,12 +1,16 @@
 package powerstrip
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/rpc"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,10 +19,15 @@ import (
 type testInterface interface {
 	Double(int) int
 	PrintKV(string, interface{})
-	Bidirectional() error
+	Bidirectional(testLogger) error
 	PrintStdio(stdout, stderr []byte)
 }
 
+// testLogger is implemented by the host and called back by the plugin.
+type testLogger interface {
+	Log(msg string) error
+}
+
 // testInterfaceImpl implements testInterface concretely
 type testInterfaceImpl struct {
 	logger *log.Logger
@@ -30,8 +39,8 @@ func (i *testInterfaceImpl) PrintKV(key string, value interface{}) {
 	i.logger.Println("PrintKV called", key, value)
 }
 
-func (i *testInterfaceImpl) Bidirectional() error {
-	return nil
+func (i *testInterfaceImpl) Bidirectional(l testLogger) error {
+	return l.Log("hello from the plugin")
 }
 
 func (i *testInterfaceImpl) PrintStdio(stdout, stderr []byte) {
@@ -57,6 +66,24 @@ func (s *testInterfaceServer) Double(arg int, resp *int) error {
 	return nil
 }
 
+// Bidirectional dials the logger the host serves on the broker stream id,
+// and calls back into it while the call is in progress.
+func (s *testInterfaceServer) Bidirectional(id uint32, _ *struct{}) error {
+	client, err := s.Broker.DialRPC(id)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return s.Impl.Bidirectional(&testLoggerClient{Client: client})
+}
+
+// Sleep is only served over RPC, to keep a call in flight.
+func (s *testInterfaceServer) Sleep(d time.Duration, _ *struct{}) error {
+	time.Sleep(d)
+	return nil
+}
+
 func (s *testInterfaceServer) PrintKV(args map[string]interface{}, _ *struct{}) error {
 	s.Impl.PrintKV(args["key"].(string), args["value"])
 	return nil
@@ -64,7 +91,8 @@ func (s *testInterfaceServer) PrintKV(args map[string]interface{}, _ *struct{})
 
 // testInterfaceClient implements testInterface to communicate over RPC
 type testInterfaceClient struct {
-	Client *rpc.Client
+	Broker *MuxBroker
+	Client Caller
 }
 
 func (impl *testInterfaceClient) Double(v int) int {
@@ -87,8 +115,43 @@ func (impl *testInterfaceClient) PrintKV(key string, value interface{}) {
 	}
 }
 
-func (impl *testInterfaceClient) Bidirectional() error {
-	return nil
+func (impl *testInterfaceClient) Bidirectional(l testLogger) error {
+	id := impl.Broker.NextId()
+	go impl.Broker.AcceptAndServe(id, "Logger", &testLoggerServer{Impl: l})
+
+	return DecodeError(impl.Client.Call("Plugin.Bidirectional", id, &struct{}{}))
+}
+
+// testLoggerServer serves a testLogger of the host to the plugin.
+type testLoggerServer struct {
+	Impl testLogger
+}
+
+func (s *testLoggerServer) Log(msg string, _ *struct{}) error {
+	return s.Impl.Log(msg)
+}
+
+// testLoggerClient calls back into the testLogger of the host.
+type testLoggerClient struct {
+	Client Caller
+}
+
+func (c *testLoggerClient) Log(msg string) error {
+	return DecodeError(c.Client.Call("Logger.Log", msg, &struct{}{}))
+}
+
+// testLoggerImpl records the messages logged to it.
+type testLoggerImpl struct {
+	lock sync.Mutex
+	msgs []string
+	err  error
+}
+
+func (l *testLoggerImpl) Log(msg string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.msgs = append(l.msgs, msg)
+	return l.err
 }
 
 func (impl *testInterfaceClient) PrintStdio(stdout, stderr []byte) {
@@ -106,11 +169,15 @@ type testInterfacePlugin struct {
 }
 
 func (p *testInterfacePlugin) Server(b *MuxBroker) (interface{}, error) {
-	return &testInterfaceServer{Impl: p.impl()}, nil
+	return &testInterfaceServer{Broker: b, Impl: p.impl()}, nil
+}
+
+func (p *testInterfacePlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return &testInterfaceClient{Broker: b, Client: c}, nil
 }
 
-func (p *testInterfacePlugin) Client(b *MuxBroker, c *rpc.Client) (interface{}, error) {
-	return &testInterfaceClient{Client: c}, nil
+func (p *testInterfacePlugin) Capabilities() map[string]string {
+	return map[string]string{"double": "int"}
 }
 
 func (p *testInterfacePlugin) impl() testInterface {
@@ -123,9 +190,182 @@ func (p *testInterfacePlugin) impl() testInterface {
 	}
 }
 
+// testArgsServer reports the arguments it was dispensed with.
+type testArgsServer struct {
+	args    interface{}
+	closeCh chan<- struct{}
+}
+
+func (s *testArgsServer) Args(null bool, resp *string) error {
+	*resp = fmt.Sprint(s.args)
+	return nil
+}
+
+func (s *testArgsServer) Close() error {
+	if s.closeCh != nil {
+		s.closeCh <- struct{}{}
+	}
+	return nil
+}
+
+// testArgsPlugin is a plugin that takes dispense arguments. Its client is
+// the bare Caller.
+type testArgsPlugin struct {
+	// CloseCh, if set, is sent to when a server instance is closed.
+	CloseCh chan<- struct{}
+}
+
+func (p *testArgsPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return p.ServerWithArgs(b, nil)
+}
+
+func (p *testArgsPlugin) ServerWithArgs(b *MuxBroker, args interface{}) (interface{}, error) {
+	return &testArgsServer{args: args, closeCh: p.CloseCh}, nil
+}
+
+func (p *testArgsPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+// testCountPlugin numbers the server instances it creates, starting at 1.
+// Its servers report their number through Args.
+type testCountPlugin struct {
+	n int32
+}
+
+func (p *testCountPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return &testArgsServer{args: atomic.AddInt32(&p.n, 1)}, nil
+}
+
+func (p *testCountPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+// testFDPlugin passes files back and forth with the host.
+type testFDPlugin struct{}
+
+func (p *testFDPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return &testFDServer{broker: b}, nil
+}
+
+func (p *testFDPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return &testFDClient{broker: b, client: c}, nil
+}
+
+type testFDClient struct {
+	broker *MuxBroker
+	client Caller
+}
+
+type testFDServer struct {
+	broker *MuxBroker
+}
+
+// ReadFile reads the file the host sent as id.
+func (s *testFDServer) ReadFile(id uint32, reply *string) error {
+	f, err := s.broker.ReceiveFile(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	*reply = string(data)
+	return err
+}
+
+// WriteConn says hello on the connection the host sent as id.
+func (s *testFDServer) WriteConn(id uint32, _ *struct{}) error {
+	conn, err := s.broker.ReceiveConn(id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	return err
+}
+
+// OpenFile opens path and sends it to the host.
+func (s *testFDServer) OpenFile(path string, id *uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	*id, err = s.broker.SendFile(f)
+	return err
+}
+
+// testContextServer has methods that take a context.
+type testContextServer struct {
+	errCh chan<- error
+}
+
+// Wait waits for d or for its context to be done. The context's error, if
+// any, is sent to errCh.
+func (s *testContextServer) Wait(ctx context.Context, d time.Duration, _ *struct{}) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		s.errCh <- ctx.Err()
+		return ctx.Err()
+	}
+}
+
+// Deadline reports the deadline of its context.
+func (s *testContextServer) Deadline(ctx context.Context, null bool, resp *time.Time) error {
+	*resp, _ = ctx.Deadline()
+	return nil
+}
+
+// testContextPlugin serves a testContextServer. Its client is the bare
+// Caller.
+type testContextPlugin struct {
+	ErrCh chan<- error
+}
+
+func (p *testContextPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return &testContextServer{errCh: p.ErrCh}, nil
+}
+
+func (p *testContextPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
+// testErrorServer returns the errors it is asked for.
+type testErrorServer struct{}
+
+func (s *testErrorServer) Fail(kind string, _ *struct{}) error {
+	switch kind {
+	case "sentinel":
+		return testErrSentinel
+	case "wrapped":
+		return fmt.Errorf("wrapping: %w", testErrSentinel)
+	case "typed":
+		return &testTypedError{Field: "value", Err: testErrSentinel}
+	case "panic":
+		panic("boom")
+	default:
+		return errors.New(kind)
+	}
+}
+
+// testErrorPlugin serves a testErrorServer. Its client is the bare
+// Caller.
+type testErrorPlugin struct{}
+
+func (p *testErrorPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return new(testErrorServer), nil
+}
+
+func (p *testErrorPlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return c, nil
+}
+
 // testPluginMap can be used for tests as a plugin map
 var testPluginMap = map[string]Plugin{
 	"test": new(testInterfacePlugin),
+	"args": new(testArgsPlugin),
 }
 
 func helperProcess(s ...string) *exec.Cmd {
@@ -170,6 +410,7 @@ func TestHelperProcess(t *testing.T) {
 
 	testPluginMap := map[string]Plugin{
 		"test": &testInterfacePlugin{Impl: testPlugin},
+		"args": new(testArgsPlugin),
 	}
 
 	cmd, args := args[0], args[1:]
@@ -178,6 +419,20 @@ func TestHelperProcess(t *testing.T) {
 		fmt.Printf("tcp|:1234\n")
 		os.Stderr.WriteString("HELLO\n")
 		os.Stderr.WriteString("WORLD\n")
+	case "crash":
+		// Leave something behind for a post-mortem, then die.
+		path := filepath.Join(os.TempDir(), "crash")
+		if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+			panic(err)
+		}
+		os.Exit(1)
+	case "start-error":
+		// Make Serve fail to create its listener.
+		os.Setenv(envSocketPairFD, "bogus")
+		Serve(&ServeConfig{
+			Plugins: testPluginMap,
+		})
+		os.Exit(0)
 	case "start-timeout":
 		time.Sleep(1 * time.Minute)
 		os.Exit(1)
@@ -201,9 +456,66 @@ func TestHelperProcess(t *testing.T) {
 
 		// Exit
 		return
+	case "orphan-host":
+		// Start a plugin and die without killing it, like a host that
+		// was SIGKILLed would.
+		c := NewClient(&ClientConfig{
+			Cmd:     helperProcess("cleanup", args[0]),
+			Plugins: testPluginMap,
+		})
+		if _, err := c.Protocol(); err != nil {
+			fmt.Fprintf(os.Stderr, "err: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "shutdown":
+		// Record that the shutdown hook ran.
+		path := args[0]
+		Serve(&ServeConfig{
+			Plugins: testPluginMap,
+			OnShutdown: func() {
+				if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+					panic(err)
+				}
+			},
+		})
+		os.Exit(0)
+	case "orphan":
+		// Serve until the host exits, checking for it often. With
+		// "disable", serve regardless.
+		parentPollInterval = 10 * time.Millisecond
+		Serve(&ServeConfig{
+			Plugins:            testPluginMap,
+			DisableOrphanCheck: len(args) > 0 && args[0] == "disable",
+		})
+		os.Exit(0)
 	case "test-interface":
 		Serve(&ServeConfig{
 			Plugins: testPluginMap,
+			Info: PluginInfo{
+				Name:    "test",
+				Version: "1.2.3",
+				Commit:  "abcdef",
+				Labels:  map[string]string{"env": "test"},
+			},
+		})
+
+		// Shouldn't reach here but make sure we exit anyways
+		os.Exit(0)
+	case "test-host-services":
+		Serve(&ServeConfig{
+			Plugins: testHostServicePluginMap,
+		})
+		os.Exit(0)
+	case "test-fd":
+		Serve(&ServeConfig{
+			Plugins: map[string]Plugin{"fd": new(testFDPlugin)},
+		})
+		os.Exit(0)
+	case "test-jsonrpc":
+		Serve(&ServeConfig{
+			Plugins: testPluginMap,
+			Codec:   CodecJSONRPC,
 		})
 
 		// Shouldn't reach here but make sure we exit anyways
@@ -15,4 +15,20 @@ type ClientProtocol interface {
 	io.Closer
 	Dispense(string) (interface{}, error)
 	Ping() error
+
+	// DispenseWithArgs is like Dispense, but passes args on to the
+	// plugin's ServerWithArgs, to configure the dispensed instance.
+	DispenseWithArgs(name string, args interface{}) (interface{}, error)
+
+	// Release tells the server that a value returned by Dispense is no
+	// longer used, so that it can clean up the implementation behind it.
+	// A value other than a pointer, map or channel is only known by the
+	// Caller its plugin's Client built it with, which it must hold.
+	Release(interface{}) error
+
+	// List returns the plugins the server can dispense, sorted by name.
+	List() ([]PluginDescriptor, error)
+
+	// Info returns the description of the plugin build.
+	Info() (*PluginInfo, error)
 }
@@ -4,34 +4,66 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/rpc"
+	"reflect"
+	"sync"
 
 	"github.com/zeroFruit/powerstrip/mux"
 )
 
 type RPCClient struct {
+	// nextCallID numbers the calls made with CallContext. It is first so
+	// that it is 64-bit aligned for atomic access.
+	nextCallID uint64
+
 	broker  *MuxBroker
-	control *rpc.Client
+	control *rpcCaller
 	plugins map[string]Plugin
 
+	// interceptors run around the calls made through the connection,
+	// which are made with callOptions first.
+	interceptors []ClientInterceptor
+	callOptions  []CallOption
+
+	// codec is the wire codec the plugin speaks.
+	codec string
+
+	// instances maps the connections serving the dispensed values that
+	// haven't been released to those values. A plugin may hand out the
+	// same value more than once, so several connections can map to it.
+	instances     map[*rpcCaller]interface{}
+	instancesLock sync.Mutex
+
 	stdout, stderr net.Conn
 }
 
 func newRPCClient(c *Client) (*RPCClient, error) {
-	conn, err := net.Dial(c.addr.Network(), c.addr.String())
-	if err != nil {
-		return nil, err
+	// A sandboxed plugin is already connected through a socketpair.
+	conn := c.pairConn
+	if conn == nil {
+		var err error
+		conn, err = net.Dial(c.addr.Network(), c.addr.String())
+		if err != nil {
+			return nil, err
+		}
 	}
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		// Make sure to set keep alive so that the connection doesn't die
 		tcpConn.SetKeepAlive(true)
 	}
 
-	result, err := NewRPCClient(conn, c.config.Plugins)
+	result, err := NewRPCClientWithCodec(conn, c.config.Plugins, c.codec)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	result.interceptors = c.config.Interceptors
+	result.callOptions = c.config.CallOptions
+
+	err = result.serveHostServices(c.config.HostServices, c.hostServiceIDs)
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
 
 	err = result.SyncStreams(c.config.SyncStdout, c.config.SyncStderr)
 	if err != nil {
@@ -42,6 +74,18 @@ func newRPCClient(c *Client) (*RPCClient, error) {
 }
 
 func NewRPCClient(conn io.ReadWriteCloser, plugins map[string]Plugin) (*RPCClient, error) {
+	return NewRPCClientWithCodec(conn, plugins, CodecGob)
+}
+
+// NewRPCClientWithCodec is like NewRPCClient, for a plugin that speaks
+// codec.
+func NewRPCClientWithCodec(
+	conn io.ReadWriteCloser, plugins map[string]Plugin, codec string) (*RPCClient, error) {
+	if err := checkCodec(codec); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	mx, err := mux.Client(conn, nil)
 	if err != nil {
 		conn.Close()
@@ -63,16 +107,25 @@ func NewRPCClient(conn io.ReadWriteCloser, plugins map[string]Plugin) (*RPCClien
 			return nil, err
 		}
 	}
-	broker := newMuxBroker(mx)
+	broker := newMuxBroker(mx, codec)
 	go broker.Run()
 
-	return &RPCClient{
-		broker:  broker,
-		control: rpc.NewClient(control),
-		plugins: plugins,
-		stdout:  stdstream[0],
-		stderr:  stdstream[1],
-	}, nil
+	controlCaller, _ := newCaller(codec, control)
+	result := &RPCClient{
+		broker:    broker,
+		plugins:   plugins,
+		codec:     codec,
+		instances: make(map[*rpcCaller]interface{}),
+		stdout:    stdstream[0],
+		stderr:    stdstream[1],
+	}
+	controlCaller.rpc = result
+	result.control = controlCaller
+
+	// Passing file descriptors is optional, so a plugin that can't is
+	// still usable; SendFile reports why.
+	result.prepareFDChannel(conn)
+	return result, nil
 }
 
 func (c *RPCClient) SyncStreams(stdout io.Writer, stderr io.Writer) error {
@@ -83,7 +136,12 @@ func (c *RPCClient) SyncStreams(stdout io.Writer, stderr io.Writer) error {
 
 func (c *RPCClient) Close() error {
 	var empty struct{}
-	returnErr := c.control.Call("Control.Quit", true, &empty)
+	returnErr := c.call("Control.Quit", true, &empty)
+
+	// Every instance goes away with the connection.
+	c.instancesLock.Lock()
+	c.instances = make(map[*rpcCaller]interface{})
+	c.instancesLock.Unlock()
 
 	if err := c.control.Close(); err != nil {
 		return err
@@ -101,13 +159,23 @@ func (c *RPCClient) Close() error {
 }
 
 func (c *RPCClient) Dispense(name string) (interface{}, error) {
+	return c.dispense(name, "Dispenser.Dispense", name)
+}
+
+func (c *RPCClient) DispenseWithArgs(name string, args interface{}) (interface{}, error) {
+	return c.dispense(name, "Dispenser.DispenseWithArgs", DispenseRequest{
+		Name: name,
+		Args: args,
+	})
+}
+
+func (c *RPCClient) dispense(name, method string, req interface{}) (interface{}, error) {
 	p, ok := c.plugins[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown plugin type: %s", name)
 	}
 	var id uint32
-	if err := c.control.Call(
-		"Dispenser.Dispense", name, &id); err != nil {
+	if err := c.call(method, req, &id); err != nil {
 		return nil, err
 	}
 
@@ -116,10 +184,125 @@ func (c *RPCClient) Dispense(name string) (interface{}, error) {
 		return nil, err
 	}
 
-	return p.Client(c.broker, rpc.NewClient(conn))
+	caller, err := newCaller(c.codec, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	caller.rpc, caller.plugin = c, name
+	raw, err := p.Client(c.broker, caller)
+	if err != nil {
+		caller.Close()
+		return nil, err
+	}
+
+	c.instancesLock.Lock()
+	c.instances[caller] = raw
+	c.instancesLock.Unlock()
+	return raw, nil
+}
+
+func (c *RPCClient) Release(raw interface{}) error {
+	if raw == nil {
+		return fmt.Errorf("not a dispensed value: %T", raw)
+	}
+
+	// The value is looked up rather than used as a key, since it may well
+	// not be hashable.
+	c.instancesLock.Lock()
+	var client *rpcCaller
+	for caller, v := range c.instances {
+		if sameInstance(v, raw, caller) {
+			client = caller
+			break
+		}
+	}
+	if client == nil {
+		c.instancesLock.Unlock()
+		return fmt.Errorf("not a dispensed value: %T", raw)
+	}
+	delete(c.instances, client)
+	c.instancesLock.Unlock()
+
+	// Closing the client closes the broker stream, which tells the server
+	// to clean up its side of the instance.
+	return client.Close()
+}
+
+// NumInstances returns the number of dispensed values that haven't been
+// released yet.
+func (c *RPCClient) NumInstances() int {
+	c.instancesLock.Lock()
+	defer c.instancesLock.Unlock()
+	return len(c.instances)
+}
+
+// sameInstance reports whether raw is v, the value dispensed with caller.
+// Pointers, maps and channels are the same when they point to the same
+// thing. Any other value is told by the caller it was built with, which it
+// must hold, directly or in a field, since copies of two instances may
+// well be equal.
+func sameInstance(v, raw interface{}, caller *rpcCaller) bool {
+	if reflect.TypeOf(v) != reflect.TypeOf(raw) {
+		return false
+	}
+	rv := reflect.ValueOf(raw)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		return rv.Pointer() == reflect.ValueOf(v).Pointer()
+	default:
+		return holdsCaller(rv, caller)
+	}
+}
+
+// holdsCaller reports whether v holds caller, looking into interfaces,
+// structs and arrays, but not behind pointers.
+func holdsCaller(v reflect.Value, caller *rpcCaller) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return !v.IsNil() && holdsCaller(v.Elem(), caller)
+	case reflect.Ptr:
+		return v.Type() == typeOfRPCCaller && v.Pointer() == reflect.ValueOf(caller).Pointer()
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if holdsCaller(v.Field(i), caller) {
+				return true
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if holdsCaller(v.Index(i), caller) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var typeOfRPCCaller = reflect.TypeOf((*rpcCaller)(nil))
+
+func (c *RPCClient) List() ([]PluginDescriptor, error) {
+	var result []PluginDescriptor
+	if err := c.call("Dispenser.List", true, &result, Idempotent()); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (c *RPCClient) Ping() error {
 	var empty struct{}
-	return c.control.Call("Control.Ping", true, &empty)
+	return c.call("Control.Ping", true, &empty, Idempotent())
+}
+
+func (c *RPCClient) Info() (*PluginInfo, error) {
+	var info PluginInfo
+	if err := c.call("Control.Info", true, &info, Idempotent()); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// call calls method on the control stream, through the interceptors.
+func (c *RPCClient) call(method string, args, reply interface{}, opts ...CallOption) error {
+	return c.control.Call(method, args, reply, opts...)
 }
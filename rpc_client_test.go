@@ -1,7 +1,473 @@
 package powerstrip
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zeroFruit/powerstrip/mux"
+)
+
+// testRPCConn returns a client connected to a server serving plugins in
+// the same process.
+func testRPCConn(t *testing.T, plugins map[string]Plugin) (*RPCClient, *RPCServer) {
+	server := &RPCServer{
+		Plugins: plugins,
+		Stdout:  new(bytes.Buffer),
+		Stderr:  new(bytes.Buffer),
+	}
+	return testRPCServe(t, server), server
+}
+
+// testRPCServe returns a client connected to server in the same process.
+func testRPCServe(t *testing.T, server *RPCServer) *RPCClient {
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	client, err := NewRPCClient(clientConn, server.Plugins)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return client
+}
 
 func TestClient_syncStreams(t *testing.T) {
 
 }
+
+func TestRPCClient_release(t *testing.T) {
+	closeCh := make(chan struct{}, 1)
+	client, server := testRPCConn(t, map[string]Plugin{
+		"args": &testArgsPlugin{CloseCh: closeCh},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("args")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := client.NumInstances(); n != 1 {
+		t.Fatalf("bad client instances: %d", n)
+	}
+	if n := server.NumInstances(); n != 1 {
+		t.Fatalf("bad server instances: %d", n)
+	}
+
+	if err := client.Release(raw); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := client.NumInstances(); n != 0 {
+		t.Fatalf("bad client instances: %d", n)
+	}
+
+	// The server closes the implementation once its stream is closed.
+	select {
+	case <-closeCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("implementation wasn't closed")
+	}
+	for server.NumInstances() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// It can't be released twice.
+	if err := client.Release(raw); err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
+
+// testUnhashableClient is a dispensed value that can't be a map key.
+type testUnhashableClient struct {
+	Caller
+	Tags interface{}
+}
+
+// testUnhashablePlugin serves a testArgsServer to a testUnhashableClient.
+type testUnhashablePlugin struct {
+	testArgsPlugin
+}
+
+func (p *testUnhashablePlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return testUnhashableClient{Caller: c, Tags: []string{"a"}}, nil
+}
+
+func TestRPCClient_releaseUnhashable(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"unhashable": new(testUnhashablePlugin),
+	})
+	defer client.Close()
+
+	var values []interface{}
+	for i := 0; i < 2; i++ {
+		raw, err := client.Dispense("unhashable")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		values = append(values, raw)
+	}
+
+	// A copy of a value is released like the value.
+	values[0] = values[0].(testUnhashableClient)
+	for i, raw := range values {
+		if err := client.Release(raw); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if n := client.NumInstances(); n != 1-i {
+			t.Fatalf("bad client instances: %d", n)
+		}
+	}
+	if err := client.Release(values[0]); err == nil {
+		t.Fatal("err should not be nil")
+	}
+}
+
+// testValuePlugin serves a testArgsServer to a value that doesn't hold
+// its Caller, so that all its instances look the same.
+type testValuePlugin struct {
+	testArgsPlugin
+}
+
+func (p *testValuePlugin) Client(b *MuxBroker, c Caller) (interface{}, error) {
+	return "value", nil
+}
+
+func TestRPCClient_releaseUnknown(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"value": new(testValuePlugin),
+	})
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Dispense("value"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Either instance could be meant, so neither is released.
+	if err := client.Release("value"); err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if n := client.NumInstances(); n != 2 {
+		t.Fatalf("bad client instances: %d", n)
+	}
+}
+
+func TestRPCClient_bidirectional(t *testing.T) {
+	client, _ := testRPCConn(t, testPluginMap)
+	defer client.Close()
+
+	raw, err := client.Dispense("test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	impl := raw.(testInterface)
+
+	// The error of the host's logger makes its way back through the
+	// plugin.
+	logger := &testLoggerImpl{err: fmt.Errorf("logging: %w", testErrSentinel)}
+	err = impl.Bidirectional(logger)
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %v", err)
+	}
+	if !reflect.DeepEqual(logger.msgs, []string{"hello from the plugin"}) {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+
+	// A second callback gets a stream of its own.
+	logger.err = nil
+	if err := impl.Bidirectional(logger); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logger.msgs) != 2 {
+		t.Fatalf("bad: %#v", logger.msgs)
+	}
+}
+
+func TestCallContext_cancel(t *testing.T) {
+	errCh := make(chan error, 1)
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"context": &testContextPlugin{ErrCh: errCh},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("context")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err = CallContext(ctx, c, "Plugin.Wait", 10*time.Second, new(struct{}))
+	if err != context.Canceled {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The server must learn that the host gave up.
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("call wasn't cancelled on the server")
+	}
+}
+
+func TestCallContext_deadline(t *testing.T) {
+	errCh := make(chan error, 1)
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"context": &testContextPlugin{ErrCh: errCh},
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("context")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var got time.Time
+	if err := CallContext(ctx, c, "Plugin.Deadline", true, &got); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !got.Equal(deadline) {
+		t.Fatalf("bad: %s", got)
+	}
+
+	// Plain calls have no deadline.
+	got = time.Time{}
+	if err := c.Call("Plugin.Deadline", true, &got); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !got.IsZero() {
+		t.Fatalf("bad: %s", got)
+	}
+
+	// The server gives up on its own once the deadline has passed, even
+	// if it isn't told to cancel.
+	orig := c.(*rpcCaller)
+	c = &rpcCaller{client: orig.client, codec: orig.codec}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	CallContext(ctx, c, "Plugin.Wait", 10*time.Second, new(struct{}))
+	select {
+	case err := <-errCh:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("call didn't time out on the server")
+	}
+}
+
+// Servers that don't know about the metadata CallContext sends, such as
+// plain net/rpc ones, must still serve the call.
+func TestCallContext_stockServer(t *testing.T) {
+	for _, codec := range []string{CodecGob, CodecJSONRPC} {
+		server := rpc.NewServer()
+		err := server.RegisterName("Plugin", &testInterfaceServer{Impl: new(testInterfaceImpl)})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		clientConn, serverConn := net.Pipe()
+		if codec == CodecGob {
+			go server.ServeConn(serverConn)
+		} else {
+			go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+		}
+
+		c, err := newCaller(codec, clientConn)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		var resp int
+		err = CallContext(ctx, c, "Plugin.Double", 21, &resp)
+		cancel()
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: err: %s", codec, err)
+		}
+		if resp != 42 {
+			t.Fatalf("%s: bad: %d", codec, resp)
+		}
+	}
+}
+
+// A Control.Cancel can get to the server before the call it cancels.
+func TestCallRegistry_earlyCancel(t *testing.T) {
+	var r callRegistry
+	r.cancel(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.add(1, cancel)
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("bad: %v", ctx.Err())
+	}
+
+	// It only cancels the call once.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r.add(1, cancel)
+	if ctx.Err() != nil {
+		t.Fatalf("bad: %v", ctx.Err())
+	}
+}
+
+// testForeignPlugin plays a plugin that isn't written in Go. It serves conn
+// by hand, speaking raw JSON-RPC 1.0 over the mux streams, and dispenses
+// "args" implementations that answer "foreign".
+func testForeignPlugin(t *testing.T, conn net.Conn) {
+	mx, err := mux.Server(conn, nil)
+	if err != nil {
+		t.Errorf("err: %s", err)
+		return
+	}
+	defer mx.Close()
+
+	// The control stream, followed by stdout and stderr.
+	control, err := mx.Accept()
+	if err != nil {
+		t.Errorf("err: %s", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := mx.Accept(); err != nil {
+			t.Errorf("err: %s", err)
+			return
+		}
+	}
+
+	testServeJSON(control, func(method string, params json.RawMessage) (interface{}, error) {
+		switch method {
+		case "Control.Ping", "Control.Quit":
+			return struct{}{}, nil
+		case "Dispenser.Dispense":
+			var args []string
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, err
+			}
+			if args[0] != "args" {
+				return nil, fmt.Errorf("unknown plugin type: %s", args[0])
+			}
+
+			// The host dials the broker stream with the ID we hand out,
+			// and waits for it to be acked.
+			const id = 1
+			go func() {
+				stream, err := mx.Accept()
+				if err != nil {
+					return
+				}
+				var got uint32
+				if err := binary.Read(stream, binary.LittleEndian, &got); err != nil || got != id {
+					stream.Close()
+					return
+				}
+				if err := binary.Write(stream, binary.LittleEndian, got); err != nil {
+					stream.Close()
+					return
+				}
+
+				testServeJSON(stream, func(method string, _ json.RawMessage) (interface{}, error) {
+					if method != "Plugin.Args" {
+						return nil, fmt.Errorf("rpc: can't find method %s", method)
+					}
+					return "foreign", nil
+				})
+			}()
+			return id, nil
+		default:
+			return nil, fmt.Errorf("rpc: can't find method %s", method)
+		}
+	})
+}
+
+// testServeJSON answers the JSON-RPC 1.0 requests on conn with handle.
+func testServeJSON(conn net.Conn, handle func(string, json.RawMessage) (interface{}, error)) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			ID     json.RawMessage `json:"id"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		resp := map[string]interface{}{"id": req.ID, "result": nil, "error": nil}
+		result, err := handle(req.Method, req.Params)
+		if err != nil {
+			resp["error"] = err.Error()
+		} else {
+			resp["result"] = result
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestRPCClient_jsonrpcForeignPlugin(t *testing.T) {
+	hostConn, pluginConn := net.Pipe()
+	go testForeignPlugin(t, pluginConn)
+
+	client, err := NewRPCClientWithCodec(hostConn, map[string]Plugin{
+		"args": new(testArgsPlugin),
+		"test": new(testInterfacePlugin),
+	}, CodecJSONRPC)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	raw, err := client.Dispense("args")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp string
+	if err := raw.(Caller).Call("Plugin.Args", true, &resp); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp != "foreign" {
+		t.Fatalf("bad: %s", resp)
+	}
+
+	// Errors come back as they were sent.
+	_, err = client.Dispense("test")
+	if err == nil || err.Error() != "unknown plugin type: test" {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestNewRPCClientWithCodec_unknown(t *testing.T) {
+	hostConn, _ := net.Pipe()
+	if _, err := NewRPCClientWithCodec(hostConn, nil, "xml"); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -0,0 +1,477 @@
+package powerstrip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"log"
+	"net/rpc"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// invalidRequest is sent as the body of error responses, like net/rpc
+// does.
+var invalidRequest = struct{}{}
+
+// dispatcher serves registered values over a rpc.ServerCodec. It speaks
+// the net/rpc wire protocol and accepts the same methods as net/rpc,
+//
+//	func (t *T) MethodName(args T1, reply *T2) error
+//
+// as well as methods that take a context first,
+//
+//	func (t *T) MethodName(ctx context.Context, args T1, reply *T2) error
+//
+// The context is cancelled when the call's deadline passes, when the host
+// cancels the call or when the connection goes away.
+type dispatcher struct {
+	services map[string]*service
+
+	// codec is the wire codec connections are served with.
+	codec string
+
+	// calls, if set, tracks the calls in flight.
+	calls *callTracker
+
+	// contexts, if set, lets Control.Cancel cancel the calls in flight.
+	contexts *callRegistry
+
+	// onPanic, if set, is called after a call panicked and the caller got
+	// its RemotePanicError.
+	onPanic func()
+}
+
+type service struct {
+	rcvr    reflect.Value
+	methods map[string]*methodType
+
+	// label is the service name interceptors see, and interceptors run
+	// around its calls.
+	label        string
+	interceptors []Interceptor
+
+	// limiter, if set, limits the calls in flight.
+	limiter *callLimiter
+}
+
+type methodType struct {
+	method      reflect.Method
+	withContext bool
+	argType     reflect.Type
+	replyType   reflect.Type
+}
+
+func newDispatcher(codec string) *dispatcher {
+	return &dispatcher{
+		services: make(map[string]*service),
+		codec:    codec,
+	}
+}
+
+// register publishes the suitable methods of rcvr under name.
+func (d *dispatcher) register(name string, rcvr interface{}) error {
+	if _, ok := d.services[name]; ok {
+		return fmt.Errorf("rpc: service already defined: %s", name)
+	}
+
+	s := &service{
+		rcvr:    reflect.ValueOf(rcvr),
+		methods: suitableMethods(reflect.TypeOf(rcvr)),
+		label:   name,
+	}
+	if len(s.methods) == 0 {
+		return fmt.Errorf("rpc: type %s has no exported methods of suitable type", s.rcvr.Type())
+	}
+	d.services[name] = s
+	return nil
+}
+
+// intercept runs interceptors around the calls to the service name, which
+// they see as label.
+func (d *dispatcher) intercept(name, label string, interceptors []Interceptor) {
+	if s, ok := d.services[name]; ok {
+		s.label = label
+		s.interceptors = interceptors
+	}
+}
+
+// limit limits the calls in flight to the service name with l.
+func (d *dispatcher) limit(name string, l *callLimiter) {
+	if s, ok := d.services[name]; ok {
+		s.limiter = l
+	}
+}
+
+func suitableMethods(typ reflect.Type) map[string]*methodType {
+	methods := make(map[string]*methodType)
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		mtype := method.Type
+		if method.PkgPath != "" {
+			continue
+		}
+
+		// Receiver, optional context, args, reply.
+		withContext := mtype.NumIn() == 4 && mtype.In(1) == typeOfContext
+		if mtype.NumIn() != 3 && !withContext {
+			continue
+		}
+		argType := mtype.In(mtype.NumIn() - 2)
+		replyType := mtype.In(mtype.NumIn() - 1)
+		if !isExportedOrBuiltinType(argType) {
+			continue
+		}
+		if replyType.Kind() != reflect.Ptr || !isExportedOrBuiltinType(replyType) {
+			continue
+		}
+		if mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+			continue
+		}
+
+		methods[method.Name] = &methodType{
+			method:      method,
+			withContext: withContext,
+			argType:     argType,
+			replyType:   replyType,
+		}
+	}
+	return methods
+}
+
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+// serveConn serves the registered values on conn.
+func (d *dispatcher) serveConn(conn io.ReadWriteCloser) {
+	codec, err := newServerCodec(d.codec, conn)
+	if err != nil {
+		conn.Close()
+		log.Printf("[ERR] plugin: %s", err)
+		return
+	}
+	if d.calls != nil {
+		codec = &trackingCodec{ServerCodec: codec, calls: d.calls}
+	}
+	d.serveCodec(codec)
+}
+
+// serveCodec serves the registered values on codec until the client hangs
+// up. Every call runs in its own goroutine.
+func (d *dispatcher) serveCodec(codec rpc.ServerCodec) {
+	// The calls of a connection are done with once it goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sending := new(sync.Mutex)
+	var wg sync.WaitGroup
+	for {
+		var req rpc.Request
+		if err := codec.ReadRequestHeader(&req); err != nil {
+			break
+		}
+
+		var meta callMeta
+		if mc, ok := codec.(metaServerCodec); ok {
+			meta = mc.requestMeta()
+		}
+		s, mtype, err := d.lookup(req.ServiceMethod)
+		if err != nil {
+			// Discard the body, we can't decode it.
+			codec.ReadRequestBody(nil)
+			d.sendResponse(sending, &req, invalidRequest, codec, err.Error())
+			continue
+		}
+
+		argv, err := mtype.readArgs(codec)
+		if err != nil {
+			d.sendResponse(sending, &req, invalidRequest, codec, err.Error())
+			continue
+		}
+
+		wg.Add(1)
+		go func(req rpc.Request) {
+			defer wg.Done()
+			d.call(ctx, sending, codec, &req, meta, s, mtype, argv)
+		}(req)
+	}
+
+	cancel()
+	wg.Wait()
+	codec.Close()
+}
+
+func (d *dispatcher) lookup(serviceMethod string) (*service, *methodType, error) {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return nil, nil, errors.New("rpc: service/method request ill-formed: " + serviceMethod)
+	}
+	name, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+
+	s, ok := d.services[name]
+	if !ok {
+		return nil, nil, errors.New("rpc: can't find service " + serviceMethod)
+	}
+	mtype, ok := s.methods[methodName]
+	if !ok {
+		return nil, nil, errors.New("rpc: can't find method " + serviceMethod)
+	}
+	return s, mtype, nil
+}
+
+func (m *methodType) readArgs(codec rpc.ServerCodec) (reflect.Value, error) {
+	var argv reflect.Value
+	argIsValue := false
+	if m.argType.Kind() == reflect.Ptr {
+		argv = reflect.New(m.argType.Elem())
+	} else {
+		argv = reflect.New(m.argType)
+		argIsValue = true
+	}
+	if err := codec.ReadRequestBody(argv.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+	return argv, nil
+}
+
+func (m *methodType) newReply() reflect.Value {
+	replyv := reflect.New(m.replyType.Elem())
+	switch m.replyType.Elem().Kind() {
+	case reflect.Map:
+		replyv.Elem().Set(reflect.MakeMap(m.replyType.Elem()))
+	case reflect.Slice:
+		replyv.Elem().Set(reflect.MakeSlice(m.replyType.Elem(), 0, 0))
+	}
+	return replyv
+}
+
+func (d *dispatcher) call(
+	ctx context.Context, sending *sync.Mutex, codec rpc.ServerCodec,
+	req *rpc.Request, meta callMeta, s *service, mtype *methodType, argv reflect.Value) {
+	replyv := mtype.newReply()
+
+	// Interceptors and limits see the context of the call even if the
+	// method doesn't take it.
+	if mtype.withContext || len(s.interceptors) > 0 || s.limiter != nil {
+		var cancel context.CancelFunc
+		if meta.deadline.IsZero() {
+			ctx, cancel = context.WithCancel(ctx)
+		} else {
+			ctx, cancel = context.WithDeadline(ctx, meta.deadline)
+		}
+		defer cancel()
+
+		if d.contexts != nil && meta.id != 0 {
+			d.contexts.add(meta.id, cancel)
+			defer d.contexts.remove(meta.id)
+		}
+	}
+
+	handler := func(ctx context.Context) error {
+		if s.limiter != nil {
+			release, err := s.limiter.acquire(ctx, mtype.method.Name)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+
+		in := []reflect.Value{s.rcvr}
+		if mtype.withContext {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		in = append(in, argv, replyv)
+
+		out := mtype.method.Func.Call(in)
+		if errInter := out[0].Interface(); errInter != nil {
+			return errInter.(error)
+		}
+		return nil
+	}
+	if len(s.interceptors) > 0 {
+		handler = chainInterceptors(s.interceptors, &CallInfo{
+			Service: s.label,
+			Method:  mtype.method.Name,
+			Args:    argv.Interface(),
+			Reply:   replyv.Interface(),
+		}, handler)
+	}
+
+	err := invoke(req.ServiceMethod, func() error { return handler(ctx) })
+
+	errmsg := ""
+	if err != nil {
+		errmsg = encodeError(err)
+	}
+	d.sendResponse(sending, req, replyv.Interface(), codec, errmsg)
+
+	if _, panicked := err.(*RemotePanicError); panicked && d.onPanic != nil {
+		d.onPanic()
+	}
+}
+
+// invoke calls fn. A panic, in the method or an interceptor, is logged and
+// returned as a RemotePanicError, so that it only fails this call instead
+// of the whole process.
+func invoke(serviceMethod string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			log.Printf("[ERR] plugin: panic in %s: %v\n%s", serviceMethod, r, stack)
+			err = &RemotePanicError{
+				Method: serviceMethod,
+				Value:  fmt.Sprint(r),
+				Stack:  string(stack),
+			}
+		}
+	}()
+
+	return fn()
+}
+
+func (d *dispatcher) sendResponse(
+	sending *sync.Mutex, req *rpc.Request, reply interface{}, codec rpc.ServerCodec, errmsg string) {
+	resp := &rpc.Response{
+		ServiceMethod: req.ServiceMethod,
+		Seq:           req.Seq,
+	}
+	if errmsg != "" {
+		resp.Error = errmsg
+		reply = invalidRequest
+	}
+
+	sending.Lock()
+	defer sending.Unlock()
+	codec.WriteResponse(resp, reply)
+}
+
+// trackingCodec is a rpc.ServerCodec that tracks the calls in flight on
+// its connection. serveCodec writes exactly one response, through
+// sendResponse, for every request header it reads, whether the call could
+// be made or not, so every call added is done once answered.
+type trackingCodec struct {
+	rpc.ServerCodec
+	calls *callTracker
+}
+
+func (c *trackingCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if err == nil {
+		c.calls.add()
+	}
+	return err
+}
+
+func (c *trackingCodec) requestMeta() callMeta {
+	if mc, ok := c.ServerCodec.(metaServerCodec); ok {
+		return mc.requestMeta()
+	}
+	return callMeta{}
+}
+
+func (c *trackingCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.calls.done()
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// callMeta is the metadata CallContext sends along with a call. The codecs
+// send it in the request header, in fields that servers who don't know
+// them ignore.
+type callMeta struct {
+	// id identifies the call to Control.Cancel. It is unique per
+	// connection, and zero if the call can't be cancelled.
+	id uint64
+
+	// deadline is when the call's context is done, if set.
+	deadline time.Time
+}
+
+// newCallMeta returns the metadata of a call from its wire form, where the
+// deadline is in Unix nanoseconds, or zero.
+func newCallMeta(id uint64, deadline int64) callMeta {
+	meta := callMeta{id: id}
+	if deadline != 0 {
+		meta.deadline = time.Unix(0, deadline)
+	}
+	return meta
+}
+
+// earlyCancelTTL is how long a Control.Cancel for a call that isn't in
+// flight is remembered, in case the call is still on its way.
+const earlyCancelTTL = time.Minute
+
+// callRegistry holds the cancel functions of the calls in flight on a
+// connection, so that Control.Cancel can find them.
+type callRegistry struct {
+	lock    sync.Mutex
+	cancels map[uint64]context.CancelFunc
+
+	// early holds the calls that were cancelled before they were added,
+	// since Control.Cancel travels on another stream than the call, with
+	// when they were cancelled.
+	early map[uint64]time.Time
+}
+
+func (r *callRegistry) add(id uint64, cancel context.CancelFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.early[id]; ok {
+		delete(r.early, id)
+		cancel()
+		return
+	}
+	if r.cancels == nil {
+		r.cancels = make(map[uint64]context.CancelFunc)
+	}
+	r.cancels[id] = cancel
+}
+
+func (r *callRegistry) remove(id uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.cancels, id)
+}
+
+// cancel cancels the call id. A call that isn't in flight yet is cancelled
+// once it is added.
+func (r *callRegistry) cancel(id uint64) {
+	r.lock.Lock()
+	cancel, ok := r.cancels[id]
+	if !ok {
+		// The cancels of calls that are already done are remembered too,
+		// so forget about the ones that are too old to still show up.
+		now := time.Now()
+		for early, at := range r.early {
+			if now.Sub(at) > earlyCancelTTL {
+				delete(r.early, early)
+			}
+		}
+		if r.early == nil {
+			r.early = make(map[uint64]time.Time)
+		}
+		r.early[id] = now
+	}
+	r.lock.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
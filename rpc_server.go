@@ -1,13 +1,14 @@
 package powerstrip
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/rpc"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zeroFruit/powerstrip/mux"
 )
@@ -15,12 +16,56 @@ import (
 type RPCServer struct {
 	Plugins map[string]Plugin
 
+	// Info is returned to the host by the Control.Info call.
+	Info PluginInfo
+
 	Stdout, Stderr io.Reader
 
+	// Codec is the wire codec connections are served with. It defaults
+	// to CodecGob.
+	Codec string
+
 	DoneCh chan<- struct{}
 
+	// ExitOnDisconnect closes DoneCh once a connection's control stream
+	// is closed, which happens when the host goes away without asking
+	// the plugin to quit.
+	ExitOnDisconnect bool
+
 	lock sync.Mutex
 
+	// dispensers holds the dispensers of the connections being served, so
+	// that shutdown can close their shared implementations. It is
+	// protected by lock.
+	dispensers map[*dispenseServer]struct{}
+
+	// MaxPanics, if positive, closes DoneCh once that many calls have
+	// panicked, since the plugin may be left in a corrupt state.
+	MaxPanics int
+
+	// Interceptors run around every call served, except the calls to the
+	// services named in SkipInterceptors: "Control", "Dispenser" or the
+	// name of a plugin.
+	Interceptors     []Interceptor
+	SkipInterceptors []string
+
+	// panics counts the calls that panicked.
+	panics int32
+
+	// calls counts the calls in flight, so that shutdown can wait for
+	// them. The Control calls are counted too, so that the reply to
+	// Control.Quit is sent before the plugin exits.
+	calls callTracker
+
+	// instances counts the dispensed implementations that are still
+	// being served.
+	instances int32
+
+	// fdTokens maps the tokens handed out by Control.FDChannel to the
+	// brokers whose file descriptor channel they open. It is protected
+	// by lock.
+	fdTokens map[uint64]*MuxBroker
+
 	logger *log.Logger
 }
 
@@ -35,7 +80,7 @@ func (s *RPCServer) Serve(lis net.Listener) {
 			log.Printf("[ERR] plugin: plugin server: %s", err)
 			return
 		}
-		go s.ServeConn(conn)
+		go s.accept(conn)
 	}
 }
 
@@ -72,20 +117,52 @@ func (s *RPCServer) ServeConn(conn io.ReadWriteCloser) {
 	go copyStream("stderr", stdstream[1], s.Stderr)
 
 	// Create the broker and start it up
-	broker := newMuxBroker(mx)
+	broker := newMuxBroker(mx, s.Codec)
+	broker.fdErr = fdTransportErr(conn)
+	broker.fdOpen = broker.requestFDChannel
 	go broker.Run()
 
+	// The calls in flight on this connection, so the host can cancel them.
+	contexts := new(callRegistry)
+
 	// Use the control connection to build the dispenser and serve the
 	// connection.
-	server := rpc.NewServer()
-	server.RegisterName("Control", &controlServer{
-		server: s,
-	})
-	server.RegisterName("Dispenser", &dispenseServer{
-		broker:  broker,
-		plugins: s.Plugins,
+	server := newDispatcher(s.Codec)
+	server.calls = &s.calls
+	server.onPanic = s.panicked
+	server.register("Control", &controlServer{
+		server:   s,
+		broker:   broker,
+		contexts: contexts,
 	})
-	server.ServeConn(control)
+	dispenser := &dispenseServer{
+		broker:   broker,
+		plugins:  s.Plugins,
+		server:   s,
+		contexts: contexts,
+	}
+	server.register("Dispenser", dispenser)
+	server.intercept("Control", "Control", s.interceptorsFor("Control"))
+	server.intercept("Dispenser", "Dispenser", s.interceptorsFor("Dispenser"))
+
+	s.lock.Lock()
+	if s.dispensers == nil {
+		s.dispensers = make(map[*dispenseServer]struct{})
+	}
+	s.dispensers[dispenser] = struct{}{}
+	s.lock.Unlock()
+
+	server.serveConn(control)
+
+	// The shared implementations go with the connection.
+	s.lock.Lock()
+	delete(s.dispensers, dispenser)
+	s.lock.Unlock()
+	dispenser.closeShared()
+
+	if s.ExitOnDisconnect {
+		s.done()
+	}
 }
 
 // done is called internally by the control server to trigger the
@@ -101,8 +178,47 @@ func (s *RPCServer) done() {
 	}
 }
 
+// panicked is called after a call panicked. It ends the server once there
+// were MaxPanics of them.
+func (s *RPCServer) panicked() {
+	n := atomic.AddInt32(&s.panics, 1)
+	if s.MaxPanics > 0 && int(n) >= s.MaxPanics {
+		log.Printf("[ERR] plugin: %d calls panicked, shutting down", n)
+		s.done()
+	}
+}
+
+// NumInstances returns the number of dispensed implementations that are
+// still being served.
+func (s *RPCServer) NumInstances() int {
+	return int(atomic.LoadInt32(&s.instances))
+}
+
+// closeShared closes the shared implementations of every connection, once
+// they aren't served anymore.
+func (s *RPCServer) closeShared() {
+	s.lock.Lock()
+	dispensers := make([]*dispenseServer, 0, len(s.dispensers))
+	for d := range s.dispensers {
+		dispensers = append(dispensers, d)
+	}
+	s.lock.Unlock()
+
+	for _, d := range dispensers {
+		d.closeShared()
+	}
+}
+
+// drain waits up to timeout for the calls in flight to finish. It reports
+// whether they did.
+func (s *RPCServer) drain(timeout time.Duration) bool {
+	return s.calls.wait(timeout)
+}
+
 type controlServer struct {
-	server *RPCServer
+	server   *RPCServer
+	broker   *MuxBroker
+	contexts *callRegistry
 }
 
 func (c *controlServer) Ping(
@@ -111,6 +227,21 @@ func (c *controlServer) Ping(
 	return nil
 }
 
+func (c *controlServer) Info(
+	null bool, response *PluginInfo) error {
+	*response = c.server.Info
+	return nil
+}
+
+// Cancel cancels the context of a call made with CallContext. Calls that
+// are already done are ignored.
+func (c *controlServer) Cancel(
+	id uint64, response *struct{}) error {
+	c.contexts.cancel(id)
+	*response = struct{}{}
+	return nil
+}
+
 func (c *controlServer) Quit(
 	null bool, response *struct{}) error {
 	// End the server
@@ -123,48 +254,154 @@ func (c *controlServer) Quit(
 }
 
 type dispenseServer struct {
-	broker  *MuxBroker
-	plugins map[string]Plugin
+	broker   *MuxBroker
+	plugins  map[string]Plugin
+	server   *RPCServer
+	contexts *callRegistry
+
+	// shared holds the implementations of the plugins that aren't
+	// dispensed with DispenseNew, and closed is set once the connection
+	// is gone. They are protected by lock.
+	lock   sync.Mutex
+	shared map[string]*sharedImpls
+	closed bool
+}
+
+func (d *dispenseServer) List(
+	null bool, response *[]PluginDescriptor) error {
+	result := make([]PluginDescriptor, 0, len(d.plugins))
+	for name, p := range d.plugins {
+		desc := PluginDescriptor{Name: name}
+		if cp, ok := lookupPlugin[CapabilityPlugin](p); ok {
+			desc.Capabilities = cp.Capabilities()
+		}
+		result = append(result, desc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	*response = result
+	return nil
 }
 
 func (d *dispenseServer) Dispense(name string, response *uint32) error {
+	return d.dispense(name, nil, response)
+}
+
+// DispenseWithArgs is Dispense with args for ServerWithArgs. It is a
+// method of its own so that Dispense stays wire compatible, see
+// DispenseRequest.
+func (d *dispenseServer) DispenseWithArgs(
+	req DispenseRequest, response *uint32) error {
+	return d.dispense(req.Name, req.Args, response)
+}
+
+func (d *dispenseServer) dispense(name string, args interface{}, response *uint32) error {
 	// Find the function to create this implementation
 	p, ok := d.plugins[name]
 	if !ok {
 		return fmt.Errorf("unknown plugin type: %s", name)
 	}
-	// Create the implementation first, so we know if there is an error.
-	impl, err := p.Server(d.broker)
+
+	// Get the implementation first, so we know if there is an error.
+	impl, release, err := d.acquire(name, p, args)
+	switch err {
+	case errNoArgs:
+		return fmt.Errorf("plugin %s doesn't take dispense arguments", name)
+	case errShared:
+		return fmt.Errorf("plugin %s is shared and can't be dispensed with arguments", name)
+	}
 	if err != nil {
-		// We turn the error into an errors error so that it works across RPC
-		return errors.New(err.Error())
+		return err
 	}
 
 	// Reserve an ID for our implementation
 	id := d.broker.NextId()
 	*response = id
+	atomic.AddInt32(&d.server.instances, 1)
 
 	// Run the rest in a goroutine since it can only happen once this RPC
 	// call returns. We wait for a connection for the plugin implementation
 	// and serve it.
 	go func() {
+		// The implementation is done with once its stream is closed,
+		// either because the host released it or the connection is gone.
+		defer atomic.AddInt32(&d.server.instances, -1)
+		defer release()
+
 		conn, err := d.broker.Accept(id)
 		if err != nil {
 			log.Printf("[ERR] go-plugin: plugin dispense error: %s: %s", name, err)
 			return
 		}
 
-		serve(conn, "Plugin", impl)
+		d.serve(conn, name, impl)
 	}()
 
 	return nil
 }
 
-func serve(conn io.ReadWriteCloser, name string, v interface{}) {
-	server := rpc.NewServer()
-	if err := server.RegisterName(name, v); err != nil {
-		log.Printf("[ERR] go-plugin: plugin dispense error: %s", err)
+// serve serves impl, an implementation of the plugin name, as "Plugin" on
+// conn.
+func (d *dispenseServer) serve(conn io.ReadWriteCloser, name string, impl *servedImpl) {
+	server := newDispatcher(d.server.Codec)
+	server.calls = &d.server.calls
+	server.contexts = d.contexts
+	server.onPanic = d.server.panicked
+	if err := server.register("Plugin", impl.impl); err != nil {
+		conn.Close()
+		log.Printf("[ERR] go-plugin: plugin dispense error: %s: %s", name, err)
 		return
 	}
-	server.ServeConn(conn)
+	server.intercept("Plugin", name, d.server.interceptorsFor(name))
+
+	server.limit("Plugin", impl.limiter)
+	server.serveConn(conn)
+}
+
+// callTracker counts calls in flight and lets shutdown wait for them.
+type callTracker struct {
+	lock   sync.Mutex
+	n      int
+	idleCh chan struct{}
+}
+
+func (t *callTracker) add() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.n++
+}
+
+func (t *callTracker) done() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.n--
+	if t.n == 0 && t.idleCh != nil {
+		close(t.idleCh)
+		t.idleCh = nil
+	}
+}
+
+// wait waits up to timeout for no calls to be in flight. It reports
+// whether that happened.
+func (t *callTracker) wait(timeout time.Duration) bool {
+	t.lock.Lock()
+	if t.n == 0 {
+		t.lock.Unlock()
+		return true
+	}
+	if t.idleCh == nil {
+		t.idleCh = make(chan struct{})
+	}
+	idleCh := t.idleCh
+	t.lock.Unlock()
+
+	select {
+	case <-idleCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
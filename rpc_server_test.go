@@ -0,0 +1,322 @@
+package powerstrip
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDispenseArgs is tryDispenseArgs failing the test on error.
+func testDispenseArgs(t *testing.T, client *RPCClient, name string) (Caller, string) {
+	c, resp, err := tryDispenseArgs(client, name)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return c, resp
+}
+
+func TestRPCServer_dispenseSingleton(t *testing.T) {
+	p := new(testCountPlugin)
+	client, server := testRPCConn(t, map[string]Plugin{
+		"count": WithDispensePolicy(p, DispensePolicy{Mode: DispenseSingleton}),
+	})
+	defer client.Close()
+
+	c1, id1 := testDispenseArgs(t, client, "count")
+	_, id2 := testDispenseArgs(t, client, "count")
+	if id1 != "1" || id2 != "1" {
+		t.Fatalf("bad: %s %s", id1, id2)
+	}
+	if n := server.NumInstances(); n != 2 {
+		t.Fatalf("bad server instances: %d", n)
+	}
+
+	// Releasing one dispense leaves the shared implementation alone.
+	if err := client.Release(c1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, id := testDispenseArgs(t, client, "count"); id != "1" {
+		t.Fatalf("bad: %s", id)
+	}
+
+	// Shared implementations can't take arguments.
+	_, err := client.DispenseWithArgs("count", "foo")
+	if err == nil || !strings.Contains(err.Error(), "can't be dispensed with arguments") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestRPCServer_dispensePool(t *testing.T) {
+	p := new(testCountPlugin)
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"count": WithDispensePolicy(p, DispensePolicy{
+			Mode:     DispensePool,
+			PoolSize: 2,
+		}),
+	})
+	defer client.Close()
+
+	c1, id1 := testDispenseArgs(t, client, "count")
+	_, id2 := testDispenseArgs(t, client, "count")
+	if id1 == id2 {
+		t.Fatalf("pooled implementations are shared: %s", id1)
+	}
+
+	_, err := client.Dispense("count")
+	expected := (&PoolExhaustedError{Name: "count", Size: 2}).Error()
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Once released, the implementation goes back to the pool.
+	if err := client.Release(c1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, id, err := tryDispenseArgs(client, "count")
+		if err == nil {
+			if id != id1 {
+				t.Fatalf("bad: %s", id)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("err: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&p.n); n != 2 {
+		t.Fatalf("bad: %d implementations created", n)
+	}
+}
+
+func TestRPCServer_dispensePoolTimeout(t *testing.T) {
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"count": WithDispensePolicy(new(testCountPlugin), DispensePolicy{
+			Mode:        DispensePool,
+			PoolSize:    1,
+			PoolTimeout: 5 * time.Second,
+		}),
+	})
+	defer client.Close()
+
+	c, id := testDispenseArgs(t, client, "count")
+
+	// A dispense waits in line until the implementation is released.
+	doneCh := make(chan string, 1)
+	go func() {
+		_, id, err := tryDispenseArgs(client, "count")
+		if err != nil {
+			id = err.Error()
+		}
+		doneCh <- id
+	}()
+
+	select {
+	case id := <-doneCh:
+		t.Fatalf("dispense didn't wait: %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := client.Release(c); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	select {
+	case got := <-doneCh:
+		if got != id {
+			t.Fatalf("bad: %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dispense still waiting")
+	}
+}
+
+func TestSharedImpls_closeWaiting(t *testing.T) {
+	policy := DispensePolicy{
+		Mode:        DispensePool,
+		PoolSize:    1,
+		PoolTimeout: 5 * time.Second,
+	}
+	p := new(testArgsPlugin)
+	s := &sharedImpls{name: "args", closeCh: make(chan struct{})}
+	if _, _, err := s.pooled(p, nil, policy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	doneCh := make(chan error, 1)
+	go func() {
+		_, _, err := s.pooled(p, nil, policy)
+		doneCh <- err
+	}()
+	select {
+	case err := <-doneCh:
+		t.Fatalf("dispense didn't wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing the connection ends the wait right away.
+	s.close()
+	select {
+	case err := <-doneCh:
+		if err != errConnClosed {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispense still waiting")
+	}
+}
+
+// testFailingPlugin fails to create its server instance number FailAt,
+// counting from 1.
+type testFailingPlugin struct {
+	testArgsPlugin
+	FailAt int32
+
+	n int32
+}
+
+func (p *testFailingPlugin) Server(b *MuxBroker) (interface{}, error) {
+	return p.ServerWithArgs(b, nil)
+}
+
+func (p *testFailingPlugin) ServerWithArgs(b *MuxBroker, args interface{}) (interface{}, error) {
+	if atomic.AddInt32(&p.n, 1) == p.FailAt {
+		return nil, errors.New("failed")
+	}
+	return p.testArgsPlugin.ServerWithArgs(b, args)
+}
+
+func TestRPCServer_dispensePoolError(t *testing.T) {
+	closeCh := make(chan struct{}, 3)
+	p := &testFailingPlugin{
+		testArgsPlugin: testArgsPlugin{CloseCh: closeCh},
+		FailAt:         2,
+	}
+	client, _ := testRPCConn(t, map[string]Plugin{
+		"fail": WithDispensePolicy(p, DispensePolicy{
+			Mode:     DispensePool,
+			PoolSize: 3,
+		}),
+	})
+	defer client.Close()
+
+	if _, err := client.Dispense("fail"); err == nil {
+		t.Fatal("err should not be nil")
+	}
+
+	// The implementation created before the failure is closed.
+	select {
+	case <-closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("implementation wasn't closed")
+	}
+
+	// The next dispense creates the whole pool again.
+	if _, _, err := tryDispenseArgs(client, "fail"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := atomic.LoadInt32(&p.n); n != 5 {
+		t.Fatalf("bad: %d implementations created", n)
+	}
+}
+
+func TestRPCServer_dispenseSharedClose(t *testing.T) {
+	impls := map[DispenseMode]int{DispenseSingleton: 1, DispensePool: 2}
+	for mode, n := range impls {
+		closeCh := make(chan struct{}, n)
+		p := &testArgsPlugin{CloseCh: closeCh}
+		client, _ := testRPCConn(t, map[string]Plugin{
+			"shared": WithDispensePolicy(p, DispensePolicy{Mode: mode, PoolSize: 2}),
+		})
+
+		c, _ := testDispenseArgs(t, client, "shared")
+		if err := client.Release(c); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		select {
+		case <-closeCh:
+			t.Fatalf("mode %d: closed on release", mode)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// The shared implementations go with the connection.
+		client.Close()
+		for i := 0; i < n; i++ {
+			select {
+			case <-closeCh:
+			case <-time.After(time.Second):
+				t.Fatalf("mode %d: implementation wasn't closed", mode)
+			}
+		}
+	}
+}
+
+// tryDispenseArgs dispenses name and returns what its server reports
+// through Args.
+func tryDispenseArgs(client *RPCClient, name string) (Caller, string, error) {
+	raw, err := client.Dispense(name)
+	if err != nil {
+		return nil, "", err
+	}
+	c := raw.(Caller)
+
+	var resp string
+	if err := c.Call("Plugin.Args", true, &resp); err != nil {
+		return nil, "", err
+	}
+	return c, resp, nil
+}
+
+func TestRPCServer_panic(t *testing.T) {
+	doneCh := make(chan struct{})
+	client := testRPCServe(t, &RPCServer{
+		Plugins:   map[string]Plugin{"error": new(testErrorPlugin)},
+		Stdout:    new(bytes.Buffer),
+		Stderr:    new(bytes.Buffer),
+		DoneCh:    doneCh,
+		MaxPanics: 2,
+	})
+	defer client.Close()
+
+	raw, err := client.Dispense("error")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c := raw.(Caller)
+
+	err = DecodeError(c.Call("Plugin.Fail", "panic", new(struct{})))
+	var panicErr *RemotePanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("bad: %#v", err)
+	}
+	if panicErr.Method != "Plugin.Fail" || panicErr.Value != "boom" {
+		t.Fatalf("bad: %#v", panicErr)
+	}
+	if !strings.Contains(panicErr.Stack, "testErrorServer") {
+		t.Fatalf("bad stack: %s", panicErr.Stack)
+	}
+
+	// The server keeps going after a panic.
+	err = DecodeError(c.Call("Plugin.Fail", "sentinel", new(struct{})))
+	if !errors.Is(err, testErrSentinel) {
+		t.Fatalf("bad: %#v", err)
+	}
+	select {
+	case <-doneCh:
+		t.Fatal("server shut down after one panic")
+	default:
+	}
+
+	// Until there were MaxPanics of them.
+	c.Call("Plugin.Fail", "panic", new(struct{}))
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
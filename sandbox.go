@@ -0,0 +1,114 @@
+package powerstrip
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// envSandbox is the path of the plugin, set by the host when it starts
+	// itself inside the sandbox to set up its mounts before exec'ing the
+	// plugin.
+	envSandbox = "POWERSTRIP_SANDBOX"
+
+	// envSandboxPluginDir is the directory that is bind mounted read-only
+	// inside the sandbox.
+	envSandboxPluginDir = "POWERSTRIP_SANDBOX_PLUGIN_DIR"
+
+	// envSandboxTmpDir is the host's temp directory, which is replaced by
+	// a private tmpfs inside the sandbox.
+	envSandboxTmpDir = "POWERSTRIP_SANDBOX_TMP_DIR"
+
+	// envSandboxInstanceDir is the per-instance directory of the plugin,
+	// if any. It stays writable inside the sandbox.
+	envSandboxInstanceDir = "POWERSTRIP_SANDBOX_INSTANCE_DIR"
+
+	// envSocketPairFD is the inherited file descriptor of the plugin end
+	// of a socketpair. When it is set the plugin serves on that connection
+	// instead of creating a unix domain socket.
+	envSocketPairFD = "POWERSTRIP_SOCKETPAIR_FD"
+)
+
+// SandboxConfig configures the namespaces a sandboxed plugin is started in.
+//
+// A sandboxed plugin runs in new user, mount, PID and network namespaces.
+// It has no network access, sees the plugin directory read-only and gets a
+// private tmpfs in place of the host's temp directory. Its instance
+// directory, if any, stays writable. The mounts are set up by the host
+// binary, which starts itself in the sandbox and drops its capabilities
+// before exec'ing the plugin, so the plugin has no way around them. The
+// host binary must therefore link this package: it re-execs itself,
+// through os.Executable, and sets up the sandbox from this package's init
+// function before main runs.
+//
+// Since the plugin can neither reach the host's network nor its temp
+// directory, it talks to the host over a socketpair inherited at start
+// instead of a unix domain socket.
+type SandboxConfig struct {
+	// PluginDir is the directory bind mounted read-only inside the sandbox.
+	// It defaults to the directory containing Cmd.Path.
+	PluginDir string
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// pairListener returns a listener that hands out the inherited end of the
+// socketpair set up by the host.
+func pairListener(fdStr string) (net.Listener, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "plugin-conn")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &connListener{
+		ch:      make(chan net.Conn, 1),
+		closeCh: make(chan struct{}),
+	}
+	l.ch <- conn
+	return l, nil
+}
+
+// connListener is an implementation of net.Listener that hands out a
+// single, already established connection and then blocks until it is
+// closed.
+type connListener struct {
+	ch        chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+
+	// Close the connection if it was never accepted.
+	select {
+	case conn := <-l.ch:
+		return conn.Close()
+	default:
+	}
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "socketpair", Net: "unix"}
+}
@@ -0,0 +1,296 @@
+//go:build linux
+// +build linux
+
+package powerstrip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// These aren't defined by the syscall package.
+const (
+	// stRelatime is ST_RELATIME.
+	stRelatime = 0x1000
+
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// sandbox prepares cmd to start in new user, mount, PID and network
+// namespaces. The host binary is started in the sandbox first, and runs
+// sandboxInit before exec'ing the plugin. It returns the plugin end of the
+// socketpair, which the caller must close once the process has started.
+func (c *Client) sandbox(cmd *exec.Cmd) (*os.File, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: finding host executable: %s", err)
+	}
+	path, err := filepath.Abs(cmd.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := c.config.Sandbox.PluginDir
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The plugin can't reach a unix domain socket in its private temp
+	// directory or anything in the host's network namespace, so connect
+	// the two ends up front.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: creating socketpair: %s", err)
+	}
+	hostFile := os.NewFile(uintptr(fds[0]), "host-conn")
+	pluginFile := os.NewFile(uintptr(fds[1]), "plugin-conn")
+
+	conn, err := net.FileConn(hostFile)
+	hostFile.Close()
+	if err != nil {
+		pluginFile.Close()
+		return nil, err
+	}
+	c.pairConn = conn
+
+	// ExtraFiles start right after stdin, stdout and stderr.
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, pluginFile)
+	cmd.Path = self
+	args := cmd.Args
+	if len(args) == 0 {
+		args = []string{path}
+	}
+	cmd.Args = append([]string{sandboxArg0}, args...)
+	cmd.Env = append(cmd.Env,
+		envSandbox+"="+path,
+		envSandboxPluginDir+"="+dir,
+		envSandboxTmpDir+"="+os.TempDir(),
+		envSandboxInstanceDir+"="+c.instanceDir,
+		fmt.Sprintf("%s=%d", envSocketPairFD, fd),
+	)
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER |
+		syscall.CLONE_NEWNS |
+		syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWNET
+	// Map the host user to root inside the user namespace so sandboxInit
+	// can set up the mounts, while keeping the host's privileges.
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+	}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+	}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+
+	return pluginFile, nil
+}
+
+// sandboxInit is the first process of the sandbox: the host binary,
+// re-executed by sandbox. Go can't run code between clone and exec, so it
+// sets up the mounts from here, in trusted code, then drops the
+// capabilities it did that with and replaces itself with the plugin. The
+// plugin can neither skip the mounts nor undo them. If anything fails, the
+// host gets the error through the handshake, and Start fails.
+func sandboxInit() {
+	// Capabilities and the no_new_privs bit belong to a thread, and exec
+	// keeps the ones of the thread calling it.
+	runtime.LockOSThread()
+
+	path := os.Getenv(envSandbox)
+	err := sandboxMount()
+	if err == nil {
+		err = dropCapabilities()
+	}
+	if err == nil {
+		err = syscall.Exec(path, os.Args[1:], sandboxEnv())
+	}
+	writeHandshakeError(fmt.Sprintf("sandbox setup: %s", err))
+	os.Exit(1)
+}
+
+// sandboxArg0 is the argv[0] sandbox starts the host binary with, ahead of
+// the plugin's own arguments.
+const sandboxArg0 = "powerstrip-sandbox-init"
+
+// isSandboxInit reports whether this process was started by sandbox to
+// run sandboxInit. The environment alone could have leaked into any
+// process, so it must also have been started with sandboxArg0, as the
+// first process of its PID namespace.
+func isSandboxInit() bool {
+	return os.Getenv(envSandbox) != "" &&
+		len(os.Args) > 1 && os.Args[0] == sandboxArg0 &&
+		os.Getpid() == 1
+}
+
+func init() {
+	if isSandboxInit() {
+		sandboxInit()
+	}
+}
+
+// sandboxEnv returns the environment of the plugin, which is ours without
+// the settings of the sandbox.
+func sandboxEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case envSandbox, envSandboxPluginDir, envSandboxTmpDir, envSandboxInstanceDir:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// sandboxMount sets up the mounts of the sandbox.
+func sandboxMount() error {
+	// Stop our mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+
+	// Hold on to the directories that have to stay visible before the
+	// temp directory is replaced, since they may well live inside it.
+	pluginDir, err := holdDir(os.Getenv(envSandboxPluginDir))
+	if err != nil {
+		return fmt.Errorf("opening plugin dir: %s", err)
+	}
+	defer pluginDir.Close()
+
+	var instanceDir *heldDir
+	if path := os.Getenv(envSandboxInstanceDir); path != "" {
+		instanceDir, err = holdDir(path)
+		if err != nil {
+			return fmt.Errorf("opening instance dir: %s", err)
+		}
+		defer instanceDir.Close()
+	}
+
+	tmp := os.Getenv(envSandboxTmpDir)
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting private tmp: %s", err)
+	}
+
+	if instanceDir != nil {
+		if err := instanceDir.bind(); err != nil {
+			return fmt.Errorf("binding instance dir: %s", err)
+		}
+	}
+	if err := pluginDir.bind(); err != nil {
+		return fmt.Errorf("binding plugin dir: %s", err)
+	}
+	dir := pluginDir.path
+
+	// A read-only remount inside a user namespace must keep the flags
+	// that are locked on the original mount. The ST_* flags reported by
+	// statfs match their MS_* counterparts, except for relatime.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	locked := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV |
+		syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		locked |= syscall.MS_RELATIME
+	}
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | locked
+	if err := syscall.Mount("", dir, "", flags, ""); err != nil {
+		return fmt.Errorf("remounting plugin dir read-only: %s", err)
+	}
+	return nil
+}
+
+// dropCapabilities drops every capability of the calling thread, for good:
+// the plugin runs as root of its user namespace, and would get them back
+// when exec'd otherwise.
+func dropCapabilities() error {
+	for c := uintptr(0); ; c++ {
+		if err := prctl(syscall.PR_CAPBSET_DROP, c); err == syscall.EINVAL {
+			// Past the last capability the kernel knows.
+			break
+		} else if err != nil {
+			return fmt.Errorf("dropping bounding set: %s", err)
+		}
+	}
+	// Ambient capabilities are newer than some kernels.
+	if err := prctl(prCapAmbient, prCapAmbientClearAll); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("clearing ambient capabilities: %s", err)
+	}
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return fmt.Errorf("setting no_new_privs: %s", err)
+	}
+
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	_, _, errno := syscall.Syscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("clearing capabilities: %s", errno)
+	}
+	return nil
+}
+
+func prctl(option, arg uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// capHeader and capData are the arguments of capset.
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// heldDir is a directory opened before the temp directory is replaced, so
+// that it can be bind mounted back in place afterwards.
+type heldDir struct {
+	path string
+	fd   int
+}
+
+func holdDir(path string) (*heldDir, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &heldDir{path: path, fd: fd}, nil
+}
+
+// bind mounts the held directory back onto its original path.
+func (d *heldDir) bind() error {
+	if err := os.MkdirAll(d.path, 0700); err != nil {
+		return err
+	}
+	src := fmt.Sprintf("/proc/self/fd/%d", d.fd)
+	return syscall.Mount(src, d.path, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+func (d *heldDir) Close() error {
+	return syscall.Close(d.fd)
+}
@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package powerstrip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClient_sandbox(t *testing.T) {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		t.Skip("user namespaces are not available")
+	}
+
+	proc := helperProcess("test-interface")
+	c := NewClient(&ClientConfig{
+		Cmd:         proc,
+		Plugins:     testPluginMap,
+		Sandbox:     &SandboxConfig{},
+		InstanceDir: &InstanceDirConfig{},
+	})
+	defer c.Kill()
+
+	proto, err := c.Protocol()
+	if err != nil {
+		t.Skipf("sandbox not supported here: %s", err)
+	}
+
+	raw, err := proto.Dispense("test")
+	if err != nil {
+		t.Fatalf("err should be nil, got %s", err)
+	}
+
+	impl, ok := raw.(testInterface)
+	if !ok {
+		t.Fatalf("bad: %#v", raw)
+	}
+
+	if result := impl.Double(21); result != 42 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// The plugin must live in its own namespaces.
+	for _, ns := range []string{"user", "mnt", "pid", "net"} {
+		host, err := os.Readlink("/proc/self/ns/" + ns)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		plugin, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", c.proc.Pid, ns))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if host == plugin {
+			t.Fatalf("plugin shares the %s namespace with the host", ns)
+		}
+	}
+
+	// It must have a private tmp, a read-only plugin directory and a
+	// writable instance directory.
+	mounts, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/mountinfo", c.proc.Pid))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var tmpfs, readOnly, instanceDir bool
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		switch fields[4] {
+		case os.TempDir():
+			tmpfs = tmpfs || strings.Contains(line, " - tmpfs ")
+		case filepath.Dir(proc.Path):
+			readOnly = readOnly || strings.HasPrefix(fields[5], "ro")
+		case c.instanceDir:
+			instanceDir = instanceDir || strings.HasPrefix(fields[5], "rw")
+		}
+	}
+	if !tmpfs {
+		t.Fatalf("no private tmp: %s", mounts)
+	}
+	if !readOnly {
+		t.Fatalf("plugin dir is not read-only: %s", mounts)
+	}
+	if !instanceDir {
+		t.Fatalf("instance dir is not writable: %s", mounts)
+	}
+
+	// And no way to undo the mounts: the plugin is root of its user
+	// namespace, but without any capabilities.
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", c.proc.Pid))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "CapInh:", "CapPrm:", "CapEff:", "CapBnd:", "CapAmb:":
+			if fields[1] != "0000000000000000" {
+				t.Fatalf("plugin has capabilities: %s", line)
+			}
+		case "NoNewPrivs:":
+			if fields[1] != "1" {
+				t.Fatalf("plugin can gain privileges: %s", line)
+			}
+		}
+	}
+
+	c.Kill()
+	if c.killed() {
+		t.Fatal("process failed to exit gracefully")
+	}
+}
+
+func TestClient_sandboxSetupError(t *testing.T) {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		t.Skip("user namespaces are not available")
+	}
+
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("test-interface"),
+		Plugins: testPluginMap,
+		Sandbox: &SandboxConfig{PluginDir: filepath.Join(t.TempDir(), "missing")},
+	})
+	defer c.Kill()
+
+	// The plugin never runs outside a sandbox that failed.
+	_, err := c.Start()
+	startErr, ok := err.(*PluginStartError)
+	if !ok {
+		t.Fatalf("bad: %#v", err)
+	}
+	if !strings.Contains(startErr.Message, "sandbox setup: opening plugin dir") {
+		t.Fatalf("bad: %s", startErr.Message)
+	}
+}
+
+func TestClient_sandboxLeakedEnv(t *testing.T) {
+	// A plugin that inherited the sandbox environment, without having
+	// been started by sandbox, must run as itself.
+	proc := helperProcess("test-interface")
+	proc.Env = append(proc.Env, envSandbox+"=/nonexistent")
+	c := NewClient(&ClientConfig{
+		Cmd:     proc,
+		Plugins: testPluginMap,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package powerstrip
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// sandbox is only supported on Linux, since it relies on namespaces.
+func (c *Client) sandbox(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("sandbox: only supported on linux")
+}
@@ -8,14 +8,65 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type PluginSet map[string]Plugin
 
 type ServeConfig struct {
 	Plugins PluginSet
+
+	// Info describes the plugin to the host.
+	Info PluginInfo
+
+	// DisableOrphanCheck keeps the plugin serving after its host has gone
+	// away. By default the plugin shuts down once the host process exits
+	// or its connection drops, so that a host that was killed doesn't
+	// leave plugins behind. Plugins that are started on their own and
+	// reattached to later should set this.
+	DisableOrphanCheck bool
+
+	// Context, if set, shuts the plugin down once it is done.
+	Context context.Context
+
+	// ShutdownTimeout is how long shutting down waits for calls in flight
+	// to finish. It defaults to 5 seconds.
+	ShutdownTimeout time.Duration
+
+	// MaxPanics, if positive, shuts the plugin down once that many calls
+	// have panicked. A panicking call otherwise only fails that call, with
+	// a RemotePanicError.
+	MaxPanics int
+
+	// Codec is the wire codec the plugin speaks, which is announced to the
+	// host in the handshake. It defaults to CodecGob.
+	Codec string
+
+	// OnShutdown, if set, is called once the calls in flight have
+	// finished, right before Serve returns.
+	OnShutdown func()
+
+	// Interceptors run around every call the plugin serves, the first one
+	// outermost: the Control calls the host manages the plugin with, the
+	// Dispenser calls it dispenses plugins with, and the calls to every
+	// dispensed implementation.
+	Interceptors []Interceptor
+
+	// SkipInterceptors names the services Interceptors don't run for:
+	// "Control", "Dispenser", or the names of plugins in Plugins.
+	SkipInterceptors []string
 }
 
+// defaultShutdownTimeout is the ShutdownTimeout used if none is set.
+const defaultShutdownTimeout = 5 * time.Second
+
+// parentPollInterval is how often the plugin checks whether its host is
+// still alive.
+var parentPollInterval = 1 * time.Second
+
 func Serve(opts *ServeConfig) {
 	exitCode := -1
 
@@ -27,8 +78,29 @@ func Serve(opts *ServeConfig) {
 
 	logger := log.New(os.Stderr, "[plugin-server] ", log.LstdFlags)
 
+	// Note who started us before anything else. The host may exit as soon
+	// as it has read the handshake, and we'd be reparented by the time we
+	// looked.
+	ppid := os.Getppid()
+
+	// Catch SIGINT and SIGTERM so we can shut down gracefully. Ctrl-C in
+	// a terminal hits the whole process group, including us, and must not
+	// kill calls in progress.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	// startFailed reports a setup error to the host through the handshake,
+	// so it doesn't just see us exit, and makes us exit with an error.
+	startFailed := func(what string, err error) {
+		logger.Println(what, "error ", err.Error())
+		writeHandshakeError(fmt.Sprintf("%s: %s", what, err))
+		exitCode = 1
+	}
+
 	lis, err := serverListener()
 	if err != nil {
+		startFailed("creating listener", err)
 		return
 	}
 	defer func() {
@@ -39,35 +111,56 @@ func Serve(opts *ServeConfig) {
 	var stdoutReader, stderrReader io.Reader
 	stdoutReader, stdoutWriter, err := os.Pipe()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error preparing plugin: %s\n", err)
-		os.Exit(1)
+		startFailed("preparing plugin", err)
+		return
 	}
 	stderrReader, stderrWriter, err := os.Pipe()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error preparing plugin: %s\n", err)
-		os.Exit(1)
+		startFailed("preparing plugin", err)
+		return
+	}
+
+	info := opts.Info
+	info.PowerstripVersion = Version
+
+	codec := opts.Codec
+	if codec == "" {
+		codec = CodecGob
+	}
+	if err := checkCodec(codec); err != nil {
+		startFailed("protocol init", err)
+		return
 	}
 
 	server := &RPCServer{
-		Plugins: opts.Plugins,
-		Stdout:  stdoutReader,
-		Stderr:  stderrReader,
-		DoneCh:  doneCh,
+		Plugins:          opts.Plugins,
+		Info:             info,
+		Stdout:           stdoutReader,
+		Stderr:           stderrReader,
+		Codec:            codec,
+		MaxPanics:        opts.MaxPanics,
+		Interceptors:     opts.Interceptors,
+		SkipInterceptors: opts.SkipInterceptors,
+		DoneCh:           doneCh,
+		ExitOnDisconnect: !opts.DisableOrphanCheck,
 	}
 
 	if err := server.Init(); err != nil {
-		logger.Println("protocol init ", "error ", err.Error())
+		startFailed("protocol init", err)
 		return
 	}
 
 	logger.Println("plugin address ", "network ",
 		lis.Addr().Network(), "address ", lis.Addr().String())
 
-	// Output the address and service name to stdout so that the client can
-	// bring it up.
-	fmt.Printf("%s|%s\n",
-		lis.Addr().Network(),
-		lis.Addr().String())
+	// Output the address to stdout so that the client can bring it up.
+	// The codec only follows when it isn't gob, so that hosts that don't
+	// know about codecs can still start gob plugins.
+	handshake := fmt.Sprintf("%s|%s", lis.Addr().Network(), lis.Addr().String())
+	if codec != CodecGob {
+		handshake += "|" + codec
+	}
+	fmt.Println(handshake)
 	os.Stdout.Sync()
 
 	// Set our stdout, stderr to the stdio stream that clients can retrieve
@@ -78,16 +171,76 @@ func Serve(opts *ServeConfig) {
 	// Accept connections and wait for completion
 	go server.Serve(lis)
 
-	ctx := context.Background()
+	// Shut down if the host dies before it even connects to us. Once the
+	// host is gone, writing to the original stdout or stderr would kill
+	// us with SIGPIPE before we got to shut down cleanly.
+	// In a PID namespace of our own, as in a sandbox, the host is outside
+	// it and our parent shows as 0. The host then can't die without the
+	// connection dropping, so ExitOnDisconnect covers it.
+	if !opts.DisableOrphanCheck {
+		signal.Ignore(syscall.SIGPIPE)
+		if ppid != 0 {
+			go watchParent(ppid, server.done)
+		}
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	select {
 	case <-ctx.Done():
-		lis.Close()
-		<-doneCh
+		logger.Println("context done, shutting down")
+	case sig := <-sigCh:
+		logger.Println("received signal, shutting down", "signal", sig)
 	case <-doneCh:
 	}
+
+	// Stop accepting new connections and give the calls in flight a
+	// chance to finish.
+	lis.Close()
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	if !server.drain(timeout) {
+		logger.Println("timeout waiting for calls in flight to finish")
+	}
+	server.closeShared()
+
+	if opts.OnShutdown != nil {
+		opts.OnShutdown()
+	}
+}
+
+// writeHandshakeError outputs the error form of the handshake, which the
+// client turns into a PluginStartError.
+func writeHandshakeError(msg string) {
+	// The handshake is a single line.
+	msg = strings.Replace(msg, "\n", " ", -1)
+	fmt.Printf("error|%s\n", msg)
+	os.Stdout.Sync()
+}
+
+// watchParent calls done once the process that started us has exited, which
+// shows as us being reparented.
+func watchParent(ppid int, done func()) {
+	for {
+		time.Sleep(parentPollInterval)
+		if os.Getppid() != ppid {
+			log.Printf("[INFO] plugin: host process %d exited, shutting down", ppid)
+			done()
+			return
+		}
+	}
 }
 
 func serverListener() (net.Listener, error) {
+	// A sandboxed plugin serves on the socketpair set up by the host.
+	if fd := os.Getenv(envSocketPairFD); fd != "" {
+		return pairListener(fd)
+	}
+
 	tf, err := ioutil.TempFile("", "plugin")
 	if err != nil {
 		return nil, err
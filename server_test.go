@@ -0,0 +1,132 @@
+package powerstrip
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startOrphan starts the "orphan" helper plugin from a shell that exits
+// once the plugin has handshaken, so the plugin is reparented as soon as
+// it is up. It returns the plugin's pid and its stdout, past the
+// handshake.
+func startOrphan(t *testing.T, args ...string) (int, *bufio.Reader) {
+	proc := helperProcess(append([]string{"orphan"}, args...)...)
+	cmd := exec.Command("sh", append([]string{"-c", `"$0" "$@" </dev/null & echo $!; read x`}, proc.Args...)...)
+	cmd.Env = proc.Env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { cmd.Wait() })
+
+	r := bufio.NewReader(stdout)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { syscall.Kill(pid, syscall.SIGKILL) })
+
+	if line, err := r.ReadString('\n'); err != nil {
+		t.Fatalf("err: %s", err)
+	} else if !strings.HasPrefix(line, "unix|") {
+		t.Fatalf("bad: %q", line)
+	}
+	stdin.Close()
+	return pid, r
+}
+
+// exited waits up to timeout for the plugin to exit, which closes its
+// stdout.
+func exited(r *bufio.Reader, timeout time.Duration) bool {
+	doneCh := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, r)
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestServe_orphaned(t *testing.T) {
+	_, r := startOrphan(t)
+	if !exited(r, 5*time.Second) {
+		t.Fatal("plugin should have exited with its host")
+	}
+}
+
+func TestServe_disableOrphanCheck(t *testing.T) {
+	pid, r := startOrphan(t, "disable")
+	if exited(r, 250*time.Millisecond) {
+		t.Fatal("plugin should have kept serving")
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestWatchParent(t *testing.T) {
+	old := parentPollInterval
+	parentPollInterval = 10 * time.Millisecond
+	defer func() { parentPollInterval = old }()
+
+	doneCh := make(chan struct{})
+	go watchParent(-1, func() { close(doneCh) })
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("done should have been called")
+	}
+}
+
+func TestServe_handshake(t *testing.T) {
+	cases := map[string]int{
+		"test-interface": 2,
+		"test-jsonrpc":   3,
+	}
+	for name, fields := range cases {
+		cmd := helperProcess(name)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// Gob plugins handshake like before there were codecs.
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		parts := strings.Split(strings.TrimSpace(line), "|")
+		if len(parts) != fields {
+			t.Fatalf("bad %s: %q", name, line)
+		}
+		if fields == 3 && parts[2] != CodecJSONRPC {
+			t.Fatalf("bad %s: %q", name, line)
+		}
+	}
+}
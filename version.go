@@ -0,0 +1,5 @@
+package powerstrip
+
+// Version is the version of powerstrip. Plugins report the version they
+// were built with in PluginInfo.
+const Version = "0.1.0"